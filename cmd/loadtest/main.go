@@ -0,0 +1,321 @@
+// Command loadtest measures how many chatters one instance can serve. It
+// signs in synthetic users, connects them all to a room and has each send
+// messages at a fixed rate, then reports ack and delivery latencies, lost
+// deliveries and errors. It exits with status 1 if anything was dropped or
+// failed, or if -max-p99 was exceeded, so it can gate a release.
+//
+//	go run ./cmd/loadtest -users 200 -rate 0.5 -duration 1m
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"rplatform-echo/internal/ws"
+
+	"github.com/coder/websocket"
+)
+
+type config struct {
+	url      string
+	users    int
+	room     string
+	rate     float64
+	duration time.Duration
+	ramp     time.Duration
+	grace    time.Duration
+	prefix   string
+	password string
+	parallel int
+	maxP99   time.Duration
+}
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	var cfg config
+	flag.StringVar(&cfg.url, "url", "http://localhost:"+port, "base URL of the instance")
+	flag.IntVar(&cfg.users, "users", 50, "number of synthetic users")
+	flag.StringVar(&cfg.room, "room", "", "room id to chat in, a new room if empty")
+	flag.Float64Var(&cfg.rate, "rate", 1, "messages per second sent by each user")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "how long to send for")
+	flag.DurationVar(&cfg.ramp, "ramp", 5*time.Second, "period to spread connects over")
+	flag.DurationVar(&cfg.grace, "grace", 5*time.Second, "how long to wait for deliveries after sending stops")
+	flag.StringVar(&cfg.prefix, "prefix", "loadtest", "prefix of the synthetic user emails")
+	flag.StringVar(&cfg.password, "password", "loadtest", "password of the synthetic users")
+	flag.IntVar(&cfg.parallel, "parallel", 8, "concurrent sign-ins while setting up")
+	flag.DurationVar(&cfg.maxP99, "max-p99", 0, "fail if the p99 delivery latency is higher, 0 to disable")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ramp+cfg.duration+cfg.grace+time.Minute)
+	defer cancel()
+
+	log.Printf("Signing in %d users at %s", cfg.users, cfg.url)
+	clients := signIn(ctx, cfg)
+	if len(clients) == 0 {
+		log.Fatal("No user could sign in")
+	}
+	if cfg.room == "" {
+		room, err := createRoom(ctx, clients[0], cfg)
+		if err != nil {
+			log.Fatalf("Error creating room: %v", err)
+		}
+		cfg.room = room
+	}
+	log.Printf("Chatting in room %s for %v", cfg.room, cfg.duration)
+
+	s := &stats{}
+	r := &run{cfg: cfg, stats: s}
+	start := time.Now()
+	r.start = start.Add(cfg.ramp)
+	r.stop = r.start.Add(cfg.duration)
+
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Go(func() { r.user(ctx, i, client) })
+	}
+	wg.Wait()
+
+	s.report(os.Stdout, cfg.users, cfg.duration)
+	if s.dropped() > 0 || s.failed() > 0 || (cfg.maxP99 > 0 && s.delivery.percentile(0.99) > cfg.maxP99) {
+		os.Exit(1)
+	}
+}
+
+// signIn registers and logs in the synthetic users, returning an HTTP
+// client holding the session of each one that made it.
+func signIn(ctx context.Context, cfg config) []*http.Client {
+	clients := make([]*http.Client, cfg.users)
+	sem := make(chan struct{}, max(cfg.parallel, 1))
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			email := fmt.Sprintf("%s-%d@loadtest.local", cfg.prefix, i)
+			client, err := login(ctx, cfg, email)
+			if err != nil {
+				log.Printf("Error signing in %s: %v", email, err)
+				return
+			}
+			clients[i] = client
+		})
+	}
+	wg.Wait()
+
+	signedIn := clients[:0]
+	for _, c := range clients {
+		if c != nil {
+			signedIn = append(signedIn, c)
+		}
+	}
+	return signedIn
+}
+
+func login(ctx context.Context, cfg config, email string) (*http.Client, error) {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	form := url.Values{"email": {email}, "password": {cfg.password}}
+
+	// registering an existing user fails harmlessly
+	res, err := postForm(ctx, client, cfg.url+"/auth/register", form)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	res, err = postForm(ctx, client, cfg.url+"/auth/login", form)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.Header.Get("HX-Redirect") == "" {
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("login refused: %s", strings.TrimSpace(string(body)))
+	}
+	return client, nil
+}
+
+func postForm(ctx context.Context, client *http.Client, u string, form url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return client.Do(req)
+}
+
+var roomIDPattern = regexp.MustCompile(`id="room-([0-9A-Z]+)"`)
+
+func createRoom(ctx context.Context, client *http.Client, cfg config) (string, error) {
+	res, err := postForm(ctx, client, cfg.url+"/dashboard/api/room", url.Values{"name": {cfg.prefix + " " + time.Now().Format(time.DateTime)}})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	m := roomIDPattern.FindSubmatch(body)
+	if res.StatusCode != http.StatusOK || m == nil {
+		return "", fmt.Errorf("status %d: %s", res.StatusCode, body)
+	}
+	return string(m[1]), nil
+}
+
+// run is one load test: users connect during the ramp, send from start to
+// stop, and hang up once the grace period after stop is over.
+type run struct {
+	cfg   config
+	stats *stats
+	start time.Time
+	stop  time.Time
+
+	// sentAt is when each client id was sent.
+	sentAt sync.Map
+}
+
+func (r *run) user(ctx context.Context, i int, client *http.Client) {
+	// spread the connects over the ramp
+	time.Sleep(time.Duration(rand.Int64N(int64(r.cfg.ramp) + 1)))
+
+	conn, err := r.dial(ctx, client)
+	if err != nil {
+		r.stats.fail("dial: " + err.Error())
+		return
+	}
+	r.stats.connected.Add(1)
+
+	readCtx, stopReading := context.WithDeadline(ctx, r.stop.Add(r.cfg.grace))
+	defer stopReading()
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		r.read(readCtx, conn)
+	}()
+
+	r.send(ctx, i, conn)
+
+	<-read
+	conn.Close(websocket.StatusNormalClosure, "load test done")
+}
+
+func (r *run) dial(ctx context.Context, client *http.Client) (*websocket.Conn, error) {
+	u := strings.Replace(r.cfg.url, "http", "ws", 1) + "/dashboard/chatroom/" + r.cfg.room
+	conn, res, err := websocket.Dial(ctx, u, &websocket.DialOptions{
+		HTTPClient:   client,
+		Subprotocols: []string{ws.SubprotocolJSON},
+	})
+	if err != nil {
+		if res != nil {
+			return nil, fmt.Errorf("status %d", res.StatusCode)
+		}
+		return nil, err
+	}
+	// room frames can be larger than the default limit
+	conn.SetReadLimit(1 << 20)
+	return conn, nil
+}
+
+// send sends messages at the configured rate from start until stop.
+func (r *run) send(ctx context.Context, i int, conn *websocket.Conn) {
+	if r.cfg.rate <= 0 {
+		return
+	}
+	interval := time.Duration(float64(time.Second) / r.cfg.rate)
+	// start each user at a random point of the interval
+	time.Sleep(time.Until(r.start) + time.Duration(rand.Int64N(int64(interval))))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := 0; time.Now().Before(r.stop); seq++ {
+		clientID := fmt.Sprintf("%s-%d-%d", r.cfg.prefix, i, seq)
+		payload, _ := json.Marshal(ws.ChatSendPayload{Content: fmt.Sprintf("load test message %d from user %d", seq, i)})
+		frame, _ := json.Marshal(ws.Envelope{
+			Type:     ws.EventChatSend,
+			Version:  ws.ProtocolVersion,
+			ClientID: clientID,
+			Payload:  payload,
+		})
+
+		r.sentAt.Store(clientID, time.Now())
+		if err := conn.Write(ctx, websocket.MessageText, frame); err != nil {
+			r.stats.fail("write: " + closeReason(err))
+			return
+		}
+		r.stats.sent.Add(1)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// read records the acks and deliveries of the run's messages until ctx is
+// done or the connection fails.
+func (r *run) read(ctx context.Context, conn *websocket.Conn) {
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.stats.fail("read: " + closeReason(err))
+			}
+			return
+		}
+		now := time.Now()
+
+		var env ws.Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			r.stats.fail("bad frame")
+			continue
+		}
+		switch env.Type {
+		case ws.EventChatAck:
+			if sent, ok := r.sentAt.Load(env.ClientID); ok {
+				r.stats.acked.Add(1)
+				r.stats.ack.record(now.Sub(sent.(time.Time)))
+			}
+		case ws.EventChatMessage:
+			if sent, ok := r.sentAt.Load(env.ClientID); ok {
+				r.stats.delivered.Add(1)
+				r.stats.delivery.record(now.Sub(sent.(time.Time)))
+			}
+		case ws.EventChatNack, ws.EventError:
+			var perr ws.ProtocolError
+			_ = json.Unmarshal(env.Payload, &perr)
+			if env.Type == ws.EventChatNack {
+				r.stats.nacked.Add(1)
+			}
+			r.stats.fail(env.Type + ": " + perr.Code)
+		}
+	}
+}
+
+// closeReason describes why a connection failed, by close status if the
+// server closed it.
+func closeReason(err error) string {
+	if status := websocket.CloseStatus(err); status != -1 {
+		return status.String()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return "connection lost"
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bucketGrowth is the ratio between histogram buckets, so percentiles are
+// within 1%.
+const bucketGrowth = 1.01
+
+// histogram records durations in log-spaced buckets from 1µs up, so
+// percentiles take the same memory however many samples there are.
+type histogram struct {
+	mu     sync.Mutex
+	counts []int64
+	n      int64
+	max    time.Duration
+}
+
+func bucketOf(d time.Duration) int {
+	us := max(d.Microseconds(), 1)
+	return int(math.Log(float64(us)) / math.Log(bucketGrowth))
+}
+
+func (h *histogram) record(d time.Duration) {
+	i := bucketOf(d)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	h.n++
+	h.max = max(h.max, d)
+}
+
+// percentile returns the upper bound of the bucket holding the p-th
+// percentile, p in [0, 1].
+func (h *histogram) percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(p * float64(h.n)))
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			upper := time.Duration(math.Pow(bucketGrowth, float64(i+1))) * time.Microsecond
+			return min(upper, h.max)
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) String() string {
+	return fmt.Sprintf("p50 %-10v p90 %-10v p99 %-10v max %v",
+		round(h.percentile(0.5)), round(h.percentile(0.9)), round(h.percentile(0.99)), round(h.max))
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
+
+// stats are the results of a run, updated by every user.
+type stats struct {
+	connected atomic.Int64
+	sent      atomic.Int64
+	acked     atomic.Int64
+	nacked    atomic.Int64
+	delivered atomic.Int64
+
+	ack      histogram
+	delivery histogram
+
+	mu     sync.Mutex
+	errors map[string]int
+}
+
+func (s *stats) fail(kind string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.errors == nil {
+		s.errors = make(map[string]int)
+	}
+	s.errors[kind]++
+}
+
+func (s *stats) failed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, count := range s.errors {
+		n += count
+	}
+	return n
+}
+
+// expected is how many deliveries the acked messages should have made:
+// every message goes to every connected user, the sender included.
+func (s *stats) expected() int64 {
+	return s.acked.Load() * s.connected.Load()
+}
+
+func (s *stats) dropped() int64 {
+	return max(s.expected()-s.delivered.Load(), 0)
+}
+
+func (s *stats) report(w io.Writer, users int, elapsed time.Duration) {
+	fmt.Fprintf(w, "users       %d connected of %d\n", s.connected.Load(), users)
+	fmt.Fprintf(w, "messages    %d sent, %d acked, %d nacked in %v (%.1f/s)\n",
+		s.sent.Load(), s.acked.Load(), s.nacked.Load(), elapsed.Round(time.Millisecond),
+		float64(s.acked.Load())/elapsed.Seconds())
+	fmt.Fprintf(w, "deliveries  %d of %d, %d dropped\n", s.delivered.Load(), s.expected(), s.dropped())
+	fmt.Fprintf(w, "ack         %v\n", &s.ack)
+	fmt.Fprintf(w, "delivery    %v\n", &s.delivery)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.errors) == 0 {
+		fmt.Fprintln(w, "errors      none")
+		return
+	}
+	kinds := make([]string, 0, len(s.errors))
+	for kind := range s.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprintln(w, "errors")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "  %-40s %d\n", kind, s.errors[kind])
+	}
+}
@@ -0,0 +1,85 @@
+// The "sse" htmx extension the chat room's compatibility mode uses: an
+// element with sse-connect opens an EventSource, and its descendants with
+// sse-swap swap in the events they name, out of band swaps included.
+// EventSources come from htmx.createEventSource, so pages can change the
+// URL of each (re)connection.
+(function () {
+	"use strict";
+
+	htmx.createEventSource = function (url) {
+		return new EventSource(url, { withCredentials: true });
+	};
+
+	function connect(elt) {
+		if (!elt.sseState) {
+			elt.sseState = { source: null, swaps: [], retries: 0, closed: false };
+			open(elt, elt.sseState);
+		}
+		return elt.sseState;
+	}
+
+	function open(elt, state) {
+		const source = htmx.createEventSource(elt.getAttribute("sse-connect"));
+		state.source = source;
+		source.onopen = function () {
+			state.retries = 0;
+			htmx.trigger(elt, "htmx:sseOpen", { source: source });
+		};
+		source.onerror = function () {
+			htmx.trigger(elt, "htmx:sseError", { source: source });
+			// the browser retries on its own unless the stream failed for good
+			if (source.readyState !== EventSource.CLOSED || state.closed) {
+				return;
+			}
+			const delay = Math.min(1000 * 2 ** state.retries, 64000);
+			state.retries++;
+			setTimeout(function () {
+				if (!state.closed && state.source === source) {
+					open(elt, state);
+				}
+			}, delay);
+		};
+		state.swaps.forEach(function (s) {
+			source.addEventListener(s.name, s.listener);
+		});
+	}
+
+	function listen(elt) {
+		const connectElt = elt.closest("[sse-connect]");
+		if (!connectElt) {
+			return;
+		}
+		const state = connect(connectElt);
+		const swapStyle = elt.getAttribute("hx-swap") || "innerHTML";
+		elt.getAttribute("sse-swap").split(",").forEach(function (name) {
+			const s = {
+				name: name.trim(),
+				listener: function (event) {
+					htmx.swap(elt, event.data, { swapStyle: swapStyle });
+				},
+			};
+			state.swaps.push(s);
+			state.source.addEventListener(s.name, s.listener);
+		});
+	}
+
+	htmx.defineExtension("sse", {
+		onEvent: function (name, evt) {
+			const elt = evt.target;
+			if (!(elt instanceof Element)) {
+				return;
+			}
+			if (name === "htmx:afterProcessNode") {
+				if (elt.hasAttribute("sse-connect")) {
+					connect(elt);
+				}
+				if (elt.hasAttribute("sse-swap")) {
+					listen(elt);
+				}
+			} else if (name === "htmx:beforeCleanupElement" && elt.sseState) {
+				elt.sseState.closed = true;
+				elt.sseState.source.close();
+			}
+		},
+	});
+})();
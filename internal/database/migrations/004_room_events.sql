@@ -0,0 +1,11 @@
+-- +goose Up
+create table if not exists room_events (
+    id integer primary key autoincrement,
+    room_id text not null,
+    origin text not null,
+    frame blob not null,
+    created_at datetime default current_timestamp
+);
+
+-- +goose Down
+drop table room_events;
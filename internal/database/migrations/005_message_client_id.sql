@@ -0,0 +1,7 @@
+-- +goose Up
+alter table messages add column client_id text;
+create unique index idx_messages_user_id_client_id on messages (user_id, client_id);
+
+-- +goose Down
+drop index if exists idx_messages_user_id_client_id;
+alter table messages drop column client_id;
@@ -0,0 +1,5 @@
+-- +goose Up
+alter table messages add column kind text not null default 'user';
+
+-- +goose Down
+alter table messages drop column kind;
@@ -0,0 +1,8 @@
+-- +goose Up
+create table if not exists revoked_tokens (
+    token_hash text primary key,
+    expires_at datetime not null
+);
+
+-- +goose Down
+drop table revoked_tokens;
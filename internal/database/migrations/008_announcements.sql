@@ -0,0 +1,26 @@
+-- +goose Up
+create table if not exists announcements (
+    id text primary key,
+    severity text not null,
+    content text not null,
+    created_by text not null,
+    created_at datetime default current_timestamp,
+    expires_at datetime not null,
+    foreign key (created_by) references users (id) on delete cascade
+);
+
+-- announcements without rows here are for every room
+create table if not exists announcement_rooms (
+    announcement_id text not null,
+    room_id text not null,
+    primary key (announcement_id, room_id),
+    foreign key (announcement_id) references announcements (id) on delete cascade,
+    foreign key (room_id) references rooms (id) on delete cascade
+);
+
+create index idx_announcements_expires_at on announcements (expires_at);
+
+-- +goose Down
+drop index if exists idx_announcements_expires_at;
+drop table announcement_rooms;
+drop table announcements;
@@ -0,0 +1,20 @@
+-- +goose Up
+alter table messages add column edited_at datetime;
+
+-- message_revisions keeps the versions a message had before each edit
+create table if not exists message_revisions (
+    id integer primary key autoincrement,
+    message_id text not null,
+    content text not null,
+    -- when this version was written: the message's creation or last edit
+    created_at datetime not null,
+    replaced_at datetime default current_timestamp,
+    foreign key (message_id) references messages (id) on delete cascade
+);
+
+create index idx_message_revisions_message_id on message_revisions (message_id);
+
+-- +goose Down
+drop index if exists idx_message_revisions_message_id;
+drop table message_revisions;
+alter table messages drop column edited_at;
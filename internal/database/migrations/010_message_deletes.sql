@@ -0,0 +1,8 @@
+-- +goose Up
+-- a deleted message stays as a tombstone with its content cleared
+alter table messages add column deleted_at datetime;
+alter table messages add column deleted_by text;
+
+-- +goose Down
+alter table messages drop column deleted_by;
+alter table messages drop column deleted_at;
@@ -0,0 +1,17 @@
+-- +goose Up
+-- a reply has a parent_id and stays out of the room's timeline unless it
+-- was also sent to the room
+alter table messages add column parent_id text references messages (id);
+alter table messages add column also_in_room boolean not null default false;
+-- kept on the thread's first message, so the room view doesn't count
+alter table messages add column reply_count integer not null default 0;
+alter table messages add column last_reply_at datetime;
+
+create index idx_messages_parent_id on messages (parent_id, id);
+
+-- +goose Down
+drop index if exists idx_messages_parent_id;
+alter table messages drop column last_reply_at;
+alter table messages drop column reply_count;
+alter table messages drop column also_in_room;
+alter table messages drop column parent_id;
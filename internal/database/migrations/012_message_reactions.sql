@@ -0,0 +1,13 @@
+-- +goose Up
+create table if not exists message_reactions (
+    message_id text not null,
+    user_id text not null,
+    emoji text not null,
+    created_at datetime default current_timestamp,
+    primary key (message_id, user_id, emoji),
+    foreign key (message_id) references messages (id) on delete cascade,
+    foreign key (user_id) references users (id) on delete cascade
+);
+
+-- +goose Down
+drop table message_reactions;
@@ -0,0 +1,18 @@
+-- +goose Up
+create table if not exists mentions (
+    message_id text not null,
+    user_id text not null,
+    room_id text not null,
+    created_at datetime default current_timestamp,
+    read_at datetime,
+    primary key (message_id, user_id),
+    foreign key (message_id) references messages (id) on delete cascade,
+    foreign key (user_id) references users (id) on delete cascade,
+    foreign key (room_id) references rooms (id) on delete cascade
+);
+
+create index idx_mentions_user_unread on mentions (user_id, read_at, created_at);
+
+-- +goose Down
+drop index if exists idx_mentions_user_unread;
+drop table mentions;
@@ -0,0 +1,26 @@
+-- +goose Up
+-- emails differing only in case are accounts to merge by hand first; the
+-- migration stops, naming them, rather than pick one
+create temp table email_case_duplicates (emails text);
+
+-- +goose StatementBegin
+create temp trigger email_case_duplicates_abort before insert on email_case_duplicates
+begin
+    select raise(abort, 'users with emails differing only in case, merge them before migrating: ' || new.emails);
+end;
+-- +goose StatementEnd
+
+insert into email_case_duplicates
+select group_concat(emails, '; ') from (
+    select group_concat(email, ', ') as emails from users
+    group by lower(email) having count(*) > 1
+)
+having count(*) > 0;
+
+drop table email_case_duplicates;
+
+update users set email = lower(email);
+create unique index idx_users_email_nocase on users (email collate nocase);
+
+-- +goose Down
+drop index if exists idx_users_email_nocase;
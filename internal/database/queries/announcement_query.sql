@@ -0,0 +1,30 @@
+-- name: CreateAnnouncement :one
+insert into announcements (id, severity, content, created_by, expires_at)
+values (?, ?, ?, ?, ?)
+returning *;
+
+-- name: AddAnnouncementRoom :exec
+insert into announcement_rooms (announcement_id, room_id)
+values (?, ?);
+
+-- name: GetActiveAnnouncements :many
+select
+    announcements.*,
+    exists (
+        select 1 from announcement_rooms
+        where announcement_rooms.announcement_id = announcements.id
+    ) as scoped
+from announcements
+where datetime (announcements.expires_at) > datetime (sqlc.arg (now))
+    and (
+        not exists (
+            select 1 from announcement_rooms
+            where announcement_rooms.announcement_id = announcements.id
+        )
+        or exists (
+            select 1 from announcement_rooms
+            where announcement_rooms.announcement_id = announcements.id
+                and announcement_rooms.room_id = sqlc.arg (room_id)
+        )
+    )
+order by announcements.created_at, announcements.id;
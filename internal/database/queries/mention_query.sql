@@ -0,0 +1,45 @@
+-- name: FindUsersByHandle :many
+select id, name, email from users
+where lower(name) = lower(sqlc.arg (handle))
+    or lower(email) = lower(sqlc.arg (handle))
+    or lower(substr(email, 1, instr(email, '@') - 1)) = lower(sqlc.arg (handle))
+limit 10;
+
+-- name: AddMention :exec
+insert or ignore into mentions (message_id, user_id, room_id)
+values (?, ?, ?);
+
+-- name: ListMessageMentions :many
+select user_id from mentions
+where message_id = ?
+order by user_id;
+
+-- name: ListUnreadMentions :many
+select
+    mentions.message_id, mentions.room_id, mentions.created_at,
+    messages.content, messages.parent_id,
+    users.id as sender_id, users.email as sender_email,
+    rooms.name as room_name
+from mentions
+join messages on messages.id = mentions.message_id
+join users on users.id = messages.user_id
+join rooms on rooms.id = mentions.room_id
+where mentions.user_id = ? and mentions.read_at is null and messages.deleted_at is null
+order by mentions.created_at desc, mentions.message_id desc
+limit ?;
+
+-- name: ReadMention :one
+update mentions set read_at = coalesce(read_at, current_timestamp)
+where message_id = ? and user_id = ?
+returning *;
+
+-- name: ReadAllMentions :exec
+update mentions set read_at = current_timestamp
+where user_id = ? and read_at is null;
+
+-- name: DeleteMessageMentions :exec
+delete from mentions where message_id = ?;
+
+-- name: DeleteMention :exec
+delete from mentions
+where message_id = ? and user_id = ?;
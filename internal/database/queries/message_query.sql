@@ -1,7 +1,15 @@
 -- name: GetInitalMessages :many
 select
     messages.id as message_id,
-    messages.content, messages.created_at,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    (select json_group_array(json_object('emoji', emoji, 'count', n, 'reacted', json(iif(reacted, 'true', 'false')))) from (
+        select emoji, count(*) as n, max(message_reactions.user_id = ?) as reacted
+        from message_reactions
+        where message_reactions.message_id = messages.id
+        group by emoji
+        order by min(message_reactions.created_at), emoji
+    )) as reactions,
     users.id as user_id,
     users.name as user_name,
     users.email as user_email,
@@ -10,33 +18,150 @@ select
 from messages
 join users on messages.user_id = users.id
 join rooms on messages.room_id = rooms.id
-where room_id = ?
-order by messages.created_at desc
+where room_id = ? and (messages.parent_id is null or messages.also_in_room)
+order by messages.created_at desc, messages.id desc
 limit 15;
 
 -- name: GetPaginatedMessages :many
 select
     messages.id as message_id,
-    messages.content, messages.created_at,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    (select json_group_array(json_object('emoji', emoji, 'count', n, 'reacted', json(iif(reacted, 'true', 'false')))) from (
+        select emoji, count(*) as n, max(message_reactions.user_id = ?) as reacted
+        from message_reactions
+        where message_reactions.message_id = messages.id
+        group by emoji
+        order by min(message_reactions.created_at), emoji
+    )) as reactions,
     users.id as user_id, users.name as user_name, users.email as user_email,
     rooms.id as room_id,
     rooms.name as room_name
 from messages
 join users on messages.user_id = users.id
 join rooms on messages.room_id = rooms.id
-where room_id = ? and datetime (messages.created_at) < datetime (?)
-order by messages.created_at desc
+where room_id = ? and (messages.parent_id is null or messages.also_in_room)
+    and datetime (messages.created_at) < datetime (?)
+order by messages.created_at desc, messages.id desc
 limit 15;
 
 -- name: CreateMessage :one
-insert into messages (id, room_id, user_id, content)
-values (?, ?, ?, ?)
+insert into messages (id, room_id, user_id, content, client_id, kind, parent_id, also_in_room)
+values (?, ?, ?, ?, ?, ?, ?, ?)
 returning * ;
 
--- name: UpdateMessage :exec
+-- name: GetMessageByClientID :one
+select * from messages
+where user_id = ? and client_id = ?
+limit 1;
+
+-- name: GetMessage :one
+select * from messages
+where id = ? limit 1;
+
+-- name: UpdateMessage :one
 update messages
-set content = ?
-where id = ? ;
+set content = ?, edited_at = current_timestamp
+where id = ?
+returning * ;
+
+-- name: CreateMessageRevision :exec
+insert into message_revisions (message_id, content, created_at)
+values (?, ?, ?);
+
+-- name: GetMessageRevisions :many
+select * from message_revisions
+where message_id = ?
+order by id;
+
+-- name: SoftDeleteMessage :one
+update messages
+set content = '', deleted_at = current_timestamp, deleted_by = ?
+where id = ?
+returning * ;
 
 -- name: DeleteMessage :exec
 delete from messages where id = ? ;
+
+-- name: DeleteMessageRevisions :exec
+delete from message_revisions where message_id = ? ;
+
+-- name: GetMessagesAfter :many
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    messages.room_id
+from messages
+join users on messages.user_id = users.id
+where messages.room_id = ? and messages.id > ?
+    and (messages.parent_id is null or messages.also_in_room)
+order by messages.id asc
+limit ?;
+
+-- name: GetMessagesUpTo :many
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    (select json_group_array(json_object('emoji', emoji, 'count', n, 'reacted', json(iif(reacted, 'true', 'false')))) from (
+        select emoji, count(*) as n, max(message_reactions.user_id = ?) as reacted
+        from message_reactions
+        where message_reactions.message_id = messages.id
+        group by emoji
+        order by min(message_reactions.created_at), emoji
+    )) as reactions,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    rooms.id as room_id,
+    rooms.name as room_name
+from messages
+join users on messages.user_id = users.id
+join rooms on messages.room_id = rooms.id
+where messages.room_id = sqlc.arg(room_id) and (messages.parent_id is null or messages.also_in_room)
+    and (messages.created_at, messages.id) <= (
+        select target.created_at, target.id from messages target
+        where target.id = sqlc.arg(message_id) and target.room_id = sqlc.arg(room_id)
+    )
+order by messages.created_at desc, messages.id desc
+limit 15;
+
+-- name: AddThreadReply :exec
+update messages
+set reply_count = reply_count + 1, last_reply_at = ?
+where id = ? ;
+
+-- name: RemoveThreadReply :exec
+update messages
+set reply_count = reply_count - 1,
+    last_reply_at = (select max(replies.created_at) from messages replies where replies.parent_id = messages.id)
+where id = ? and reply_count > 0 ;
+
+-- name: GetThreadRoot :one
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.reply_count, messages.last_reply_at,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    messages.room_id
+from messages
+join users on messages.user_id = users.id
+where messages.id = ? and messages.room_id = ? and messages.parent_id is null
+limit 1;
+
+-- name: GetThreadReplies :many
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    messages.room_id
+from messages
+join users on messages.user_id = users.id
+where messages.parent_id = ? and messages.id > ?
+order by messages.id asc
+limit ?;
+
+-- name: GetThreadReplyIDs :many
+select id from messages
+where parent_id = ?
+order by id asc;
@@ -0,0 +1,14 @@
+-- name: AddReaction :exec
+insert into message_reactions (message_id, user_id, emoji)
+values (?, ?, ?);
+
+-- name: DeleteReaction :execrows
+delete from message_reactions
+where message_id = ? and user_id = ? and emoji = ?;
+
+-- name: CountReactions :one
+select count(*) from message_reactions
+where message_id = ? and emoji = ?;
+
+-- name: DeleteMessageReactions :exec
+delete from message_reactions where message_id = ?;
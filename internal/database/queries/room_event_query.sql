@@ -0,0 +1,16 @@
+-- name: CreateRoomEvent :exec
+insert into room_events (room_id, origin, frame)
+values (?, ?, ?) ;
+
+-- name: GetRoomEventsAfter :many
+select * from room_events
+where id > ?
+order by id
+limit ? ;
+
+-- name: GetLatestRoomEventID :one
+select cast(coalesce(max(id), 0) as integer) from room_events ;
+
+-- name: DeleteRoomEventsBefore :exec
+delete from room_events
+where datetime (created_at) < datetime (?) ;
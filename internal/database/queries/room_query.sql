@@ -19,3 +19,28 @@ where id = ? ;
 
 -- name: DeleteRoom :exec
 delete from rooms where id = ? ;
+
+-- name: SearchRoomMembers :many
+select users.id, users.name, users.email
+from users
+join room_users on room_users.user_id = users.id
+where room_users.room_id = sqlc.arg (room_id)
+    and (users.name like sqlc.arg (prefix) escape '\' or users.email like sqlc.arg (prefix) escape '\')
+order by users.name
+limit sqlc.arg (limit);
+
+-- name: AddRoomUser :execrows
+insert into room_users (room_id, user_id)
+values (?, ?)
+on conflict do nothing;
+
+-- name: RemoveRoomUser :execrows
+delete from room_users
+where room_id = ? and user_id = ?;
+
+-- name: ListRoomUsers :many
+select users.id, users.email
+from room_users
+join users on room_users.user_id = users.id
+where room_users.room_id = ?
+order by users.email;
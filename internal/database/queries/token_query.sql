@@ -0,0 +1,12 @@
+-- name: RevokeToken :exec
+insert into revoked_tokens (token_hash, expires_at)
+values (?, ?)
+on conflict (token_hash) do nothing;
+
+-- name: ListRevokedTokens :many
+select * from revoked_tokens
+where datetime (expires_at) >= datetime (?);
+
+-- name: DeleteExpiredTokens :exec
+delete from revoked_tokens
+where datetime (expires_at) < datetime (?);
@@ -8,19 +8,40 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
+const addThreadReply = `-- name: AddThreadReply :exec
+update messages
+set reply_count = reply_count + 1, last_reply_at = ?
+where id = ?
+`
+
+type AddThreadReplyParams struct {
+	LastReplyAt sql.NullTime
+	ID          string
+}
+
+func (q *Queries) AddThreadReply(ctx context.Context, arg AddThreadReplyParams) error {
+	_, err := q.db.ExecContext(ctx, addThreadReply, arg.LastReplyAt, arg.ID)
+	return err
+}
+
 const createMessage = `-- name: CreateMessage :one
-insert into messages (id, room_id, user_id, content)
-values (?, ?, ?, ?)
-returning id, room_id, user_id, content, created_at
+insert into messages (id, room_id, user_id, content, client_id, kind, parent_id, also_in_room)
+values (?, ?, ?, ?, ?, ?, ?, ?)
+returning id, room_id, user_id, content, created_at, client_id, kind, edited_at, deleted_at, deleted_by, parent_id, also_in_room, reply_count, last_reply_at
 `
 
 type CreateMessageParams struct {
-	ID      string
-	RoomID  string
-	UserID  string
-	Content string
+	ID         string
+	RoomID     string
+	UserID     string
+	Content    string
+	ClientID   sql.NullString
+	Kind       string
+	ParentID   sql.NullString
+	AlsoInRoom bool
 }
 
 func (q *Queries) CreateMessage(ctx context.Context, arg CreateMessageParams) (Message, error) {
@@ -29,6 +50,10 @@ func (q *Queries) CreateMessage(ctx context.Context, arg CreateMessageParams) (M
 		arg.RoomID,
 		arg.UserID,
 		arg.Content,
+		arg.ClientID,
+		arg.Kind,
+		arg.ParentID,
+		arg.AlsoInRoom,
 	)
 	var i Message
 	err := row.Scan(
@@ -37,10 +62,35 @@ func (q *Queries) CreateMessage(ctx context.Context, arg CreateMessageParams) (M
 		&i.UserID,
 		&i.Content,
 		&i.CreatedAt,
+		&i.ClientID,
+		&i.Kind,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.ParentID,
+		&i.AlsoInRoom,
+		&i.ReplyCount,
+		&i.LastReplyAt,
 	)
 	return i, err
 }
 
+const createMessageRevision = `-- name: CreateMessageRevision :exec
+insert into message_revisions (message_id, content, created_at)
+values (?, ?, ?)
+`
+
+type CreateMessageRevisionParams struct {
+	MessageID string
+	Content   string
+	CreatedAt time.Time
+}
+
+func (q *Queries) CreateMessageRevision(ctx context.Context, arg CreateMessageRevisionParams) error {
+	_, err := q.db.ExecContext(ctx, createMessageRevision, arg.MessageID, arg.Content, arg.CreatedAt)
+	return err
+}
+
 const deleteMessage = `-- name: DeleteMessage :exec
 ;
 
@@ -52,10 +102,29 @@ func (q *Queries) DeleteMessage(ctx context.Context, id string) error {
 	return err
 }
 
+const deleteMessageRevisions = `-- name: DeleteMessageRevisions :exec
+;
+
+delete from message_revisions where message_id = ?
+`
+
+func (q *Queries) DeleteMessageRevisions(ctx context.Context, messageID string) error {
+	_, err := q.db.ExecContext(ctx, deleteMessageRevisions, messageID)
+	return err
+}
+
 const getInitalMessages = `-- name: GetInitalMessages :many
 select
     messages.id as message_id,
-    messages.content, messages.created_at,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    (select json_group_array(json_object('emoji', emoji, 'count', n, 'reacted', json(iif(reacted, 'true', 'false')))) from (
+        select emoji, count(*) as n, max(message_reactions.user_id = ?) as reacted
+        from message_reactions
+        where message_reactions.message_id = messages.id
+        group by emoji
+        order by min(message_reactions.created_at), emoji
+    )) as reactions,
     users.id as user_id,
     users.name as user_name,
     users.email as user_email,
@@ -64,24 +133,36 @@ select
 from messages
 join users on messages.user_id = users.id
 join rooms on messages.room_id = rooms.id
-where room_id = ?
-order by messages.created_at desc
+where room_id = ? and (messages.parent_id is null or messages.also_in_room)
+order by messages.created_at desc, messages.id desc
 limit 15
 `
 
 type GetInitalMessagesRow struct {
-	MessageID string
-	Content   string
-	CreatedAt sql.NullTime
-	UserID    string
-	UserName  string
-	UserEmail string
-	RoomID    string
-	RoomName  string
+	MessageID   string
+	Content     string
+	CreatedAt   sql.NullTime
+	Kind        string
+	EditedAt    sql.NullTime
+	DeletedAt   sql.NullTime
+	ParentID    sql.NullString
+	ReplyCount  int64
+	LastReplyAt sql.NullTime
+	Reactions   string
+	UserID      string
+	UserName    string
+	UserEmail   string
+	RoomID      string
+	RoomName    string
 }
 
-func (q *Queries) GetInitalMessages(ctx context.Context, roomID string) ([]GetInitalMessagesRow, error) {
-	rows, err := q.db.QueryContext(ctx, getInitalMessages, roomID)
+type GetInitalMessagesParams struct {
+	UserID string
+	RoomID string
+}
+
+func (q *Queries) GetInitalMessages(ctx context.Context, arg GetInitalMessagesParams) ([]GetInitalMessagesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getInitalMessages, arg.UserID, arg.RoomID)
 	if err != nil {
 		return nil, err
 	}
@@ -93,6 +174,272 @@ func (q *Queries) GetInitalMessages(ctx context.Context, roomID string) ([]GetIn
 			&i.MessageID,
 			&i.Content,
 			&i.CreatedAt,
+			&i.Kind,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ReplyCount,
+			&i.LastReplyAt,
+			&i.Reactions,
+			&i.UserID,
+			&i.UserName,
+			&i.UserEmail,
+			&i.RoomID,
+			&i.RoomName,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMessage = `-- name: GetMessage :one
+select id, room_id, user_id, content, created_at, client_id, kind, edited_at, deleted_at, deleted_by, parent_id, also_in_room, reply_count, last_reply_at from messages
+where id = ? limit 1
+`
+
+func (q *Queries) GetMessage(ctx context.Context, id string) (Message, error) {
+	row := q.db.QueryRowContext(ctx, getMessage, id)
+	var i Message
+	err := row.Scan(
+		&i.ID,
+		&i.RoomID,
+		&i.UserID,
+		&i.Content,
+		&i.CreatedAt,
+		&i.ClientID,
+		&i.Kind,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.ParentID,
+		&i.AlsoInRoom,
+		&i.ReplyCount,
+		&i.LastReplyAt,
+	)
+	return i, err
+}
+
+const getMessageByClientID = `-- name: GetMessageByClientID :one
+select id, room_id, user_id, content, created_at, client_id, kind, edited_at, deleted_at, deleted_by, parent_id, also_in_room, reply_count, last_reply_at from messages
+where user_id = ? and client_id = ?
+limit 1
+`
+
+type GetMessageByClientIDParams struct {
+	UserID   string
+	ClientID sql.NullString
+}
+
+func (q *Queries) GetMessageByClientID(ctx context.Context, arg GetMessageByClientIDParams) (Message, error) {
+	row := q.db.QueryRowContext(ctx, getMessageByClientID, arg.UserID, arg.ClientID)
+	var i Message
+	err := row.Scan(
+		&i.ID,
+		&i.RoomID,
+		&i.UserID,
+		&i.Content,
+		&i.CreatedAt,
+		&i.ClientID,
+		&i.Kind,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.ParentID,
+		&i.AlsoInRoom,
+		&i.ReplyCount,
+		&i.LastReplyAt,
+	)
+	return i, err
+}
+
+const getMessageRevisions = `-- name: GetMessageRevisions :many
+select id, message_id, content, created_at, replaced_at from message_revisions
+where message_id = ?
+order by id
+`
+
+func (q *Queries) GetMessageRevisions(ctx context.Context, messageID string) ([]MessageRevision, error) {
+	rows, err := q.db.QueryContext(ctx, getMessageRevisions, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []MessageRevision
+	for rows.Next() {
+		var i MessageRevision
+		if err := rows.Scan(
+			&i.ID,
+			&i.MessageID,
+			&i.Content,
+			&i.CreatedAt,
+			&i.ReplacedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMessagesAfter = `-- name: GetMessagesAfter :many
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    messages.room_id
+from messages
+join users on messages.user_id = users.id
+where messages.room_id = ? and messages.id > ?
+    and (messages.parent_id is null or messages.also_in_room)
+order by messages.id asc
+limit ?
+`
+
+type GetMessagesAfterParams struct {
+	RoomID string
+	ID     string
+	Limit  int64
+}
+
+type GetMessagesAfterRow struct {
+	MessageID   string
+	Content     string
+	CreatedAt   sql.NullTime
+	Kind        string
+	EditedAt    sql.NullTime
+	DeletedAt   sql.NullTime
+	ParentID    sql.NullString
+	ReplyCount  int64
+	LastReplyAt sql.NullTime
+	UserID      string
+	UserName    string
+	UserEmail   string
+	RoomID      string
+}
+
+func (q *Queries) GetMessagesAfter(ctx context.Context, arg GetMessagesAfterParams) ([]GetMessagesAfterRow, error) {
+	rows, err := q.db.QueryContext(ctx, getMessagesAfter, arg.RoomID, arg.ID, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetMessagesAfterRow
+	for rows.Next() {
+		var i GetMessagesAfterRow
+		if err := rows.Scan(
+			&i.MessageID,
+			&i.Content,
+			&i.CreatedAt,
+			&i.Kind,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ReplyCount,
+			&i.LastReplyAt,
+			&i.UserID,
+			&i.UserName,
+			&i.UserEmail,
+			&i.RoomID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMessagesUpTo = `-- name: GetMessagesUpTo :many
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    (select json_group_array(json_object('emoji', emoji, 'count', n, 'reacted', json(iif(reacted, 'true', 'false')))) from (
+        select emoji, count(*) as n, max(message_reactions.user_id = ?1) as reacted
+        from message_reactions
+        where message_reactions.message_id = messages.id
+        group by emoji
+        order by min(message_reactions.created_at), emoji
+    )) as reactions,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    rooms.id as room_id,
+    rooms.name as room_name
+from messages
+join users on messages.user_id = users.id
+join rooms on messages.room_id = rooms.id
+where messages.room_id = ?2 and (messages.parent_id is null or messages.also_in_room)
+    and (messages.created_at, messages.id) <= (
+        select target.created_at, target.id from messages target
+        where target.id = ?3 and target.room_id = ?2
+    )
+order by messages.created_at desc, messages.id desc
+limit 15
+`
+
+type GetMessagesUpToParams struct {
+	UserID    string
+	RoomID    string
+	MessageID string
+}
+
+type GetMessagesUpToRow struct {
+	MessageID   string
+	Content     string
+	CreatedAt   sql.NullTime
+	Kind        string
+	EditedAt    sql.NullTime
+	DeletedAt   sql.NullTime
+	ParentID    sql.NullString
+	ReplyCount  int64
+	LastReplyAt sql.NullTime
+	Reactions   string
+	UserID      string
+	UserName    string
+	UserEmail   string
+	RoomID      string
+	RoomName    string
+}
+
+func (q *Queries) GetMessagesUpTo(ctx context.Context, arg GetMessagesUpToParams) ([]GetMessagesUpToRow, error) {
+	rows, err := q.db.QueryContext(ctx, getMessagesUpTo, arg.UserID, arg.RoomID, arg.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetMessagesUpToRow
+	for rows.Next() {
+		var i GetMessagesUpToRow
+		if err := rows.Scan(
+			&i.MessageID,
+			&i.Content,
+			&i.CreatedAt,
+			&i.Kind,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ReplyCount,
+			&i.LastReplyAt,
+			&i.Reactions,
 			&i.UserID,
 			&i.UserName,
 			&i.UserEmail,
@@ -115,52 +462,194 @@ func (q *Queries) GetInitalMessages(ctx context.Context, roomID string) ([]GetIn
 const getPaginatedMessages = `-- name: GetPaginatedMessages :many
 select
     messages.id as message_id,
-    messages.content, messages.created_at,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.parent_id, messages.reply_count, messages.last_reply_at,
+    (select json_group_array(json_object('emoji', emoji, 'count', n, 'reacted', json(iif(reacted, 'true', 'false')))) from (
+        select emoji, count(*) as n, max(message_reactions.user_id = ?) as reacted
+        from message_reactions
+        where message_reactions.message_id = messages.id
+        group by emoji
+        order by min(message_reactions.created_at), emoji
+    )) as reactions,
     users.id as user_id, users.name as user_name, users.email as user_email,
     rooms.id as room_id,
     rooms.name as room_name
 from messages
 join users on messages.user_id = users.id
 join rooms on messages.room_id = rooms.id
-where room_id = ? and datetime (messages.created_at) < datetime (?)
-order by messages.created_at desc
+where room_id = ? and (messages.parent_id is null or messages.also_in_room)
+    and datetime (messages.created_at) < datetime (?)
+order by messages.created_at desc, messages.id desc
 limit 15
 `
 
 type GetPaginatedMessagesParams struct {
+	UserID   string
 	RoomID   string
 	Datetime interface{}
 }
 
 type GetPaginatedMessagesRow struct {
+	MessageID   string
+	Content     string
+	CreatedAt   sql.NullTime
+	Kind        string
+	EditedAt    sql.NullTime
+	DeletedAt   sql.NullTime
+	ParentID    sql.NullString
+	ReplyCount  int64
+	LastReplyAt sql.NullTime
+	Reactions   string
+	UserID      string
+	UserName    string
+	UserEmail   string
+	RoomID      string
+	RoomName    string
+}
+
+func (q *Queries) GetPaginatedMessages(ctx context.Context, arg GetPaginatedMessagesParams) ([]GetPaginatedMessagesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getPaginatedMessages, arg.UserID, arg.RoomID, arg.Datetime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetPaginatedMessagesRow
+	for rows.Next() {
+		var i GetPaginatedMessagesRow
+		if err := rows.Scan(
+			&i.MessageID,
+			&i.Content,
+			&i.CreatedAt,
+			&i.Kind,
+			&i.EditedAt,
+			&i.DeletedAt,
+			&i.ParentID,
+			&i.ReplyCount,
+			&i.LastReplyAt,
+			&i.Reactions,
+			&i.UserID,
+			&i.UserName,
+			&i.UserEmail,
+			&i.RoomID,
+			&i.RoomName,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const removeThreadReply = `-- name: RemoveThreadReply :exec
+;
+
+update messages
+set reply_count = reply_count - 1,
+    last_reply_at = (select max(replies.created_at) from messages replies where replies.parent_id = messages.id)
+where id = ? and reply_count > 0
+`
+
+func (q *Queries) RemoveThreadReply(ctx context.Context, id string) error {
+	_, err := q.db.ExecContext(ctx, removeThreadReply, id)
+	return err
+}
+
+const softDeleteMessage = `-- name: SoftDeleteMessage :one
+;
+
+update messages
+set content = '', deleted_at = current_timestamp, deleted_by = ?
+where id = ?
+returning id, room_id, user_id, content, created_at, client_id, kind, edited_at, deleted_at, deleted_by, parent_id, also_in_room, reply_count, last_reply_at
+`
+
+type SoftDeleteMessageParams struct {
+	DeletedBy sql.NullString
+	ID        string
+}
+
+func (q *Queries) SoftDeleteMessage(ctx context.Context, arg SoftDeleteMessageParams) (Message, error) {
+	row := q.db.QueryRowContext(ctx, softDeleteMessage, arg.DeletedBy, arg.ID)
+	var i Message
+	err := row.Scan(
+		&i.ID,
+		&i.RoomID,
+		&i.UserID,
+		&i.Content,
+		&i.CreatedAt,
+		&i.ClientID,
+		&i.Kind,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.ParentID,
+		&i.AlsoInRoom,
+		&i.ReplyCount,
+		&i.LastReplyAt,
+	)
+	return i, err
+}
+
+const getThreadReplies = `-- name: GetThreadReplies :many
+;
+
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    messages.room_id
+from messages
+join users on messages.user_id = users.id
+where messages.parent_id = ? and messages.id > ?
+order by messages.id asc
+limit ?
+`
+
+type GetThreadRepliesParams struct {
+	ParentID sql.NullString
+	ID       string
+	Limit    int64
+}
+
+type GetThreadRepliesRow struct {
 	MessageID string
 	Content   string
 	CreatedAt sql.NullTime
+	Kind      string
+	EditedAt  sql.NullTime
+	DeletedAt sql.NullTime
 	UserID    string
 	UserName  string
 	UserEmail string
 	RoomID    string
-	RoomName  string
 }
 
-func (q *Queries) GetPaginatedMessages(ctx context.Context, arg GetPaginatedMessagesParams) ([]GetPaginatedMessagesRow, error) {
-	rows, err := q.db.QueryContext(ctx, getPaginatedMessages, arg.RoomID, arg.Datetime)
+func (q *Queries) GetThreadReplies(ctx context.Context, arg GetThreadRepliesParams) ([]GetThreadRepliesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getThreadReplies, arg.ParentID, arg.ID, arg.Limit)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []GetPaginatedMessagesRow
+	var items []GetThreadRepliesRow
 	for rows.Next() {
-		var i GetPaginatedMessagesRow
+		var i GetThreadRepliesRow
 		if err := rows.Scan(
 			&i.MessageID,
 			&i.Content,
 			&i.CreatedAt,
+			&i.Kind,
+			&i.EditedAt,
+			&i.DeletedAt,
 			&i.UserID,
 			&i.UserName,
 			&i.UserEmail,
 			&i.RoomID,
-			&i.RoomName,
 		); err != nil {
 			return nil, err
 		}
@@ -175,12 +664,66 @@ func (q *Queries) GetPaginatedMessages(ctx context.Context, arg GetPaginatedMess
 	return items, nil
 }
 
-const updateMessage = `-- name: UpdateMessage :exec
+const getThreadRoot = `-- name: GetThreadRoot :one
 ;
 
+select
+    messages.id as message_id,
+    messages.content, messages.created_at, messages.kind, messages.edited_at, messages.deleted_at,
+    messages.reply_count, messages.last_reply_at,
+    users.id as user_id, users.name as user_name, users.email as user_email,
+    messages.room_id
+from messages
+join users on messages.user_id = users.id
+where messages.id = ? and messages.room_id = ? and messages.parent_id is null
+limit 1
+`
+
+type GetThreadRootParams struct {
+	ID     string
+	RoomID string
+}
+
+type GetThreadRootRow struct {
+	MessageID   string
+	Content     string
+	CreatedAt   sql.NullTime
+	Kind        string
+	EditedAt    sql.NullTime
+	DeletedAt   sql.NullTime
+	ReplyCount  int64
+	LastReplyAt sql.NullTime
+	UserID      string
+	UserName    string
+	UserEmail   string
+	RoomID      string
+}
+
+func (q *Queries) GetThreadRoot(ctx context.Context, arg GetThreadRootParams) (GetThreadRootRow, error) {
+	row := q.db.QueryRowContext(ctx, getThreadRoot, arg.ID, arg.RoomID)
+	var i GetThreadRootRow
+	err := row.Scan(
+		&i.MessageID,
+		&i.Content,
+		&i.CreatedAt,
+		&i.Kind,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.ReplyCount,
+		&i.LastReplyAt,
+		&i.UserID,
+		&i.UserName,
+		&i.UserEmail,
+		&i.RoomID,
+	)
+	return i, err
+}
+
+const updateMessage = `-- name: UpdateMessage :one
 update messages
-set content = ?
+set content = ?, edited_at = current_timestamp
 where id = ?
+returning id, room_id, user_id, content, created_at, client_id, kind, edited_at, deleted_at, deleted_by, parent_id, also_in_room, reply_count, last_reply_at
 `
 
 type UpdateMessageParams struct {
@@ -188,7 +731,53 @@ type UpdateMessageParams struct {
 	ID      string
 }
 
-func (q *Queries) UpdateMessage(ctx context.Context, arg UpdateMessageParams) error {
-	_, err := q.db.ExecContext(ctx, updateMessage, arg.Content, arg.ID)
-	return err
+func (q *Queries) UpdateMessage(ctx context.Context, arg UpdateMessageParams) (Message, error) {
+	row := q.db.QueryRowContext(ctx, updateMessage, arg.Content, arg.ID)
+	var i Message
+	err := row.Scan(
+		&i.ID,
+		&i.RoomID,
+		&i.UserID,
+		&i.Content,
+		&i.CreatedAt,
+		&i.ClientID,
+		&i.Kind,
+		&i.EditedAt,
+		&i.DeletedAt,
+		&i.DeletedBy,
+		&i.ParentID,
+		&i.AlsoInRoom,
+		&i.ReplyCount,
+		&i.LastReplyAt,
+	)
+	return i, err
+}
+
+const getThreadReplyIDs = `-- name: GetThreadReplyIDs :many
+select id from messages
+where parent_id = ?
+order by id asc
+`
+
+func (q *Queries) GetThreadReplyIDs(ctx context.Context, parentID sql.NullString) ([]string, error) {
+	rows, err := q.db.QueryContext(ctx, getThreadReplyIDs, parentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
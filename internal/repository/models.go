@@ -6,22 +6,82 @@ package repository
 
 import (
 	"database/sql"
+	"time"
 )
 
-type Message struct {
+type Announcement struct {
 	ID        string
+	Severity  string
+	Content   string
+	CreatedBy string
+	CreatedAt sql.NullTime
+	ExpiresAt time.Time
+}
+
+type AnnouncementRoom struct {
+	AnnouncementID string
+	RoomID         string
+}
+
+type Mention struct {
+	MessageID string
+	UserID    string
 	RoomID    string
+	CreatedAt sql.NullTime
+	ReadAt    sql.NullTime
+}
+
+type Message struct {
+	ID          string
+	RoomID      string
+	UserID      string
+	Content     string
+	CreatedAt   sql.NullTime
+	ClientID    sql.NullString
+	Kind        string
+	EditedAt    sql.NullTime
+	DeletedAt   sql.NullTime
+	DeletedBy   sql.NullString
+	ParentID    sql.NullString
+	AlsoInRoom  bool
+	ReplyCount  int64
+	LastReplyAt sql.NullTime
+}
+
+type MessageReaction struct {
+	MessageID string
 	UserID    string
-	Content   string
+	Emoji     string
 	CreatedAt sql.NullTime
 }
 
+type MessageRevision struct {
+	ID         int64
+	MessageID  string
+	Content    string
+	CreatedAt  time.Time
+	ReplacedAt sql.NullTime
+}
+
+type RevokedToken struct {
+	TokenHash string
+	ExpiresAt time.Time
+}
+
 type Room struct {
 	ID        string
 	Name      string
 	CreatedAt sql.NullTime
 }
 
+type RoomEvent struct {
+	ID        int64
+	RoomID    string
+	Origin    string
+	Frame     []byte
+	CreatedAt sql.NullTime
+}
+
 type RoomUser struct {
 	RoomID   string
 	UserID   string
@@ -9,6 +9,25 @@ import (
 	"context"
 )
 
+const addRoomUser = `-- name: AddRoomUser :execrows
+insert into room_users (room_id, user_id)
+values (?, ?)
+on conflict do nothing
+`
+
+type AddRoomUserParams struct {
+	RoomID string
+	UserID string
+}
+
+func (q *Queries) AddRoomUser(ctx context.Context, arg AddRoomUserParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, addRoomUser, arg.RoomID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const createRoom = `-- name: CreateRoom :one
 INSERT INTO rooms (
     id, name
@@ -79,6 +98,105 @@ func (q *Queries) GetRoom(ctx context.Context, id string) (Room, error) {
 	return i, err
 }
 
+const listRoomUsers = `-- name: ListRoomUsers :many
+select users.id, users.email
+from room_users
+join users on room_users.user_id = users.id
+where room_users.room_id = ?
+order by users.email
+`
+
+type ListRoomUsersRow struct {
+	ID    string
+	Email string
+}
+
+func (q *Queries) ListRoomUsers(ctx context.Context, roomID string) ([]ListRoomUsersRow, error) {
+	rows, err := q.db.QueryContext(ctx, listRoomUsers, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRoomUsersRow
+	for rows.Next() {
+		var i ListRoomUsersRow
+		if err := rows.Scan(&i.ID, &i.Email); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const removeRoomUser = `-- name: RemoveRoomUser :execrows
+delete from room_users
+where room_id = ? and user_id = ?
+`
+
+type RemoveRoomUserParams struct {
+	RoomID string
+	UserID string
+}
+
+func (q *Queries) RemoveRoomUser(ctx context.Context, arg RemoveRoomUserParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, removeRoomUser, arg.RoomID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const searchRoomMembers = `-- name: SearchRoomMembers :many
+select users.id, users.name, users.email
+from users
+join room_users on room_users.user_id = users.id
+where room_users.room_id = ?1
+    and (users.name like ?2 escape '\' or users.email like ?2 escape '\')
+order by users.name
+limit ?3
+`
+
+type SearchRoomMembersParams struct {
+	RoomID string
+	Prefix string
+	Limit  int64
+}
+
+type SearchRoomMembersRow struct {
+	ID    string
+	Name  string
+	Email string
+}
+
+func (q *Queries) SearchRoomMembers(ctx context.Context, arg SearchRoomMembersParams) ([]SearchRoomMembersRow, error) {
+	rows, err := q.db.QueryContext(ctx, searchRoomMembers, arg.RoomID, arg.Prefix, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchRoomMembersRow
+	for rows.Next() {
+		var i SearchRoomMembersRow
+		if err := rows.Scan(&i.ID, &i.Name, &i.Email); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const updateRoom = `-- name: UpdateRoom :exec
 ;
 
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"rplatform-echo/internal/services"
+	"rplatform-echo/internal/ws"
+)
+
+// wsConfig reads the chat socket tunables from the environment, keeping the
+// defaults for anything unset or invalid.
+func wsConfig() ws.Config {
+	cfg := ws.DefaultConfig()
+	cfg.PingInterval = envDuration("WS_PING_INTERVAL", cfg.PingInterval)
+	cfg.PongTimeout = envDuration("WS_PONG_TIMEOUT", cfg.PongTimeout)
+	cfg.MaxMissedPongs = envCount("WS_MAX_MISSED_PONGS", cfg.MaxMissedPongs)
+	cfg.ReadTimeout = envDuration("WS_READ_TIMEOUT", cfg.ReadTimeout)
+	cfg.RoomIdleTimeout = envDuration("WS_ROOM_IDLE_TIMEOUT", cfg.RoomIdleTimeout)
+	cfg.PresenceGrace = envDuration("WS_PRESENCE_GRACE", cfg.PresenceGrace)
+	cfg.ReconnectJitter = envDuration("WS_RECONNECT_JITTER", cfg.ReconnectJitter)
+	cfg.SendBufferSize = envCount("WS_SEND_BUFFER", cfg.SendBufferSize)
+	cfg.MaxViolations = envCount("WS_MAX_VIOLATIONS", cfg.MaxViolations)
+	cfg.MuteDuration = envDuration("WS_MUTE_DURATION", cfg.MuteDuration)
+	cfg.MaxMutes = envInt("WS_MAX_MUTES", cfg.MaxMutes)
+	cfg.AllowedOrigins = envList("WS_ALLOWED_ORIGINS")
+	cfg.AuthCheckInterval = envDuration("WS_AUTH_CHECK_INTERVAL", cfg.AuthCheckInterval)
+	// admins moderate too
+	for email := range moderatorEmails() {
+		cfg.Moderators = append(cfg.Moderators, email)
+	}
+	for email := range adminEmails() {
+		cfg.Moderators = append(cfg.Moderators, email)
+	}
+	if c := ws.Compression(os.Getenv("WS_COMPRESSION")); c.Valid() {
+		cfg.Compression = c
+	}
+	cfg.CompressionThreshold = envInt("WS_COMPRESSION_THRESHOLD", cfg.CompressionThreshold)
+	if p := ws.SlowConsumerPolicy(os.Getenv("WS_SLOW_CONSUMER")); p.Valid() {
+		cfg.Room.SlowConsumer = p
+	}
+	cfg.Room.MaxFrameSize = int64(envInt("WS_MAX_FRAME_SIZE", int(cfg.Room.MaxFrameSize)))
+	cfg.Room.ConnRate = envFloat("WS_CONN_RATE", cfg.Room.ConnRate)
+	cfg.Room.ConnBurst = envInt("WS_CONN_BURST", cfg.Room.ConnBurst)
+	cfg.Room.UserRate = envFloat("WS_USER_RATE", cfg.Room.UserRate)
+	cfg.Room.UserBurst = envInt("WS_USER_BURST", cfg.Room.UserBurst)
+	cfg.Rooms = roomConfigs(cfg.Room)
+	return cfg
+}
+
+// messageWriterConfig reads the message persistence tunables from the
+// environment.
+func messageWriterConfig() services.MessageWriterConfig {
+	cfg := services.DefaultMessageWriterConfig()
+	cfg.QueueSize = envCount("MESSAGE_QUEUE_SIZE", cfg.QueueSize)
+	cfg.FlushInterval = envDuration("MESSAGE_FLUSH_INTERVAL", cfg.FlushInterval)
+	cfg.MaxBatch = envCount("MESSAGE_MAX_BATCH", cfg.MaxBatch)
+	return cfg
+}
+
+// roomConfigs reads per-room overrides from WS_ROOMS, a JSON object of room
+// id to the fields of ws.RoomConfig to change, e.g.
+// {"01J...":{"slow_consumer":"resync","user_rate":2}}.
+func roomConfigs(def ws.RoomConfig) map[string]ws.RoomConfig {
+	raw := os.Getenv("WS_ROOMS")
+	if raw == "" {
+		return nil
+	}
+	var overrides map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &overrides); err != nil {
+		log.Printf("Ignoring WS_ROOMS: %v", err)
+		return nil
+	}
+	rooms := make(map[string]ws.RoomConfig, len(overrides))
+	for id, o := range overrides {
+		rc := def
+		if err := json.Unmarshal(o, &rc); err != nil || !rc.SlowConsumer.Valid() {
+			log.Printf("Ignoring WS_ROOMS entry for room %s", id)
+			continue
+		}
+		rooms[id] = rc
+	}
+	return rooms
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+func envFloat(key string, def float64) float64 {
+	f, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil || f < 0 {
+		return def
+	}
+	return f
+}
+
+// envInt reads a non-negative int, where 0 is usually "no limit".
+func envInt(key string, def int) int {
+	n, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || n < 0 {
+		return def
+	}
+	return n
+}
+
+// envCount reads an int that has to be at least 1, such as a buffer size.
+func envCount(key string, def int) int {
+	if n := envInt(key, def); n > 0 {
+		return n
+	}
+	return def
+}
+
+// adminEmails reads ADMIN_EMAILS, the comma separated emails of the users
+// allowed to make announcements.
+func adminEmails() map[string]bool {
+	return emailSet("ADMIN_EMAILS")
+}
+
+// moderatorEmails reads MODERATOR_EMAILS, the comma separated emails of the
+// users allowed to review message history and delete any message.
+func moderatorEmails() map[string]bool {
+	return emailSet("MODERATOR_EMAILS")
+}
+
+func emailSet(key string) map[string]bool {
+	emails := make(map[string]bool)
+	for _, email := range envList(key) {
+		emails[strings.ToLower(email)] = true
+	}
+	return emails
+}
+
+// envList reads a comma separated list, skipping empty items.
+func envList(key string) []string {
+	var items []string
+	for item := range strings.SplitSeq(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
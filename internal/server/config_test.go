@@ -0,0 +1,22 @@
+package server
+
+import (
+	"testing"
+
+	"rplatform-echo/internal/ws"
+)
+
+func TestWSConfigZero(t *testing.T) {
+	t.Setenv("WS_MAX_FRAME_SIZE", "0")
+	t.Setenv("WS_SEND_BUFFER", "0")
+	t.Setenv("WS_CONN_BURST", "-1")
+
+	cfg, def := wsConfig(), ws.DefaultConfig()
+	if cfg.Room.MaxFrameSize != 0 {
+		t.Errorf("MaxFrameSize = %d, want 0 for no limit", cfg.Room.MaxFrameSize)
+	}
+	if cfg.SendBufferSize != def.SendBufferSize || cfg.Room.ConnBurst != def.Room.ConnBurst {
+		t.Errorf("SendBufferSize, ConnBurst = %d, %d, want the defaults %d, %d",
+			cfg.SendBufferSize, cfg.Room.ConnBurst, def.SendBufferSize, def.Room.ConnBurst)
+	}
+}
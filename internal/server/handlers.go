@@ -3,9 +3,12 @@ package server
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"regexp"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -13,6 +16,9 @@ import (
 	"rplatform-echo/cmd/web"
 	"rplatform-echo/cmd/web/components/toast"
 	"rplatform-echo/internal/repository"
+	"rplatform-echo/internal/services"
+	"rplatform-echo/internal/ws"
+	"rplatform-echo/utils"
 
 	"github.com/coder/websocket"
 	"github.com/golang-jwt/jwt/v5"
@@ -64,9 +70,15 @@ func (s *Server) websocketHandler(c echo.Context) error {
 	return nil
 }
 
+// normalizeEmail is how emails are stored and looked up, so that the ones
+// differing only in case are one user.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func (s *Server) registerHanlder(c echo.Context) error {
 	password := c.FormValue("password")
-	email := c.FormValue("email")
+	email := normalizeEmail(c.FormValue("email"))
 	errorMsg := ""
 
 	// Basic validation (add more robust validation as needed)
@@ -103,7 +115,7 @@ func (s *Server) registerHanlder(c echo.Context) error {
 
 func (s *Server) loginHandler(c echo.Context) error {
 	password := c.FormValue("password")
-	email := c.FormValue("email")
+	email := normalizeEmail(c.FormValue("email"))
 	errorMsg := ""
 
 	// Basic validation (add more robust validation as needed)
@@ -150,6 +162,11 @@ func (s *Server) loginHandler(c echo.Context) error {
 }
 
 func (s *Server) logOutHandler(c echo.Context) error {
+	// the cookie is only dropped by this browser, so the token is revoked
+	// too in case it was copied, and to close its open chat sockets
+	if cookie, err := c.Cookie("jwt_token"); err == nil {
+		s.revokeToken(c, cookie.Value)
+	}
 	cookie := &http.Cookie{
 		Name:     "jwt_token",
 		Value:    "",
@@ -163,6 +180,215 @@ func (s *Server) logOutHandler(c echo.Context) error {
 	return c.String(http.StatusFound, "OK")
 }
 
+// revokeToken revokes a session token until it expires. Invalid tokens are
+// ignored, they don't work anyway.
+func (s *Server) revokeToken(c echo.Context, raw string) {
+	token, err := jwt.Parse(raw, func(t *jwt.Token) (any, error) {
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return
+	}
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return
+	}
+	if err := s.tokenSvc.Revoke(c.Request().Context(), raw, exp.Time); err != nil {
+		log.Println("Error revoking token", err)
+	}
+}
+
+// rejectRevoked sends users whose session was revoked back to sign in. It
+// runs after the JWT middleware, which only checks the signature and expiry.
+func (s *Server) rejectRevoked(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token := c.Get("user").(*jwt.Token)
+		if s.tokenSvc.IsRevoked(c.Request().Context(), token.Raw) {
+			return c.Redirect(http.StatusFound, "/auth")
+		}
+		return next(c)
+	}
+}
+
+// requireAdmin only lets the users listed in ADMIN_EMAILS through.
+func (s *Server) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get("user").(*jwt.Token)
+		claims := user.Claims.(jwt.MapClaims)
+		email, _ := claims["email"].(string)
+		if !s.admins[strings.ToLower(email)] {
+			return echo.NewHTTPError(http.StatusForbidden, "admins only")
+		}
+		return next(c)
+	}
+}
+
+// requireModerator only lets the users listed in MODERATOR_EMAILS or
+// ADMIN_EMAILS through.
+func (s *Server) requireModerator(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := c.Get("user").(*jwt.Token)
+		claims := user.Claims.(jwt.MapClaims)
+		email, _ := claims["email"].(string)
+		email = strings.ToLower(email)
+		if !s.moderators[email] && !s.admins[email] {
+			return echo.NewHTTPError(http.StatusForbidden, "moderators only")
+		}
+		return next(c)
+	}
+}
+
+type messageRevision struct {
+	Content    string    `json:"content"`
+	CreatedAt  time.Time `json:"created_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+type messageHistory struct {
+	ID        string            `json:"id"`
+	UserID    string            `json:"user_id"`
+	Content   string            `json:"content"`
+	CreatedAt time.Time         `json:"created_at"`
+	EditedAt  *time.Time        `json:"edited_at,omitempty"`
+	DeletedAt *time.Time        `json:"deleted_at,omitempty"`
+	DeletedBy string            `json:"deleted_by,omitempty"`
+	Revisions []messageRevision `json:"revisions"`
+}
+
+// getRevisionsHandler returns a message along with the versions it replaced,
+// oldest first.
+func (s *Server) getRevisionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	roomID, messageID := c.Param("roomID"), c.Param("messageID")
+	msg, err := s.messageSvc.Get(ctx, roomID, messageID)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Println("Error getting message", err)
+		return err
+	}
+	revs, err := s.messageSvc.Revisions(ctx, roomID, messageID)
+	if err != nil {
+		log.Println("Error getting revisions", err)
+		return err
+	}
+
+	history := messageHistory{
+		ID:        msg.ID,
+		UserID:    msg.UserID,
+		Content:   msg.Content,
+		CreatedAt: msg.CreatedAt.Time,
+		Revisions: make([]messageRevision, 0, len(revs)),
+	}
+	history.EditedAt = nullTime(msg.EditedAt)
+	if msg.DeletedAt.Valid {
+		history.DeletedAt = nullTime(msg.DeletedAt)
+		history.DeletedBy = msg.DeletedBy.String
+	}
+	for _, r := range revs {
+		history.Revisions = append(history.Revisions, messageRevision{
+			Content:    r.Content,
+			CreatedAt:  r.CreatedAt,
+			ReplacedAt: r.ReplacedAt.Time,
+		})
+	}
+	return c.JSON(http.StatusOK, history)
+}
+
+// purgeMessageHandler removes a message and its history for good, such as
+// for a legal takedown, and drops it from the open chat rooms. Purging the
+// root of a thread purges its replies too.
+func (s *Server) purgeMessageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	roomID, messageID := c.Param("roomID"), c.Param("messageID")
+	purged, err := s.messageSvc.Purge(ctx, roomID, messageID)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Println("Error purging message", err)
+		return err
+	}
+	for _, id := range purged {
+		if err := s.roomManager.Purged(ctx, roomID, id); err != nil {
+			log.Println("Error pushing purge", id, err)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+type announcementRequest struct {
+	Severity string `json:"severity" form:"severity"`
+	Content  string `json:"content" form:"content"`
+	// ExpiresAt is an RFC 3339 time; ExpiresIn a duration such as "2h",
+	// used if ExpiresAt is empty. It defaults to an hour.
+	ExpiresAt string `json:"expires_at" form:"expires_at"`
+	ExpiresIn string `json:"expires_in" form:"expires_in"`
+	// Rooms scopes the announcement to some rooms, empty for every room.
+	Rooms []string `json:"rooms" form:"rooms"`
+}
+
+// createAnnouncementHandler stores an announcement and pushes it to the
+// connected clients of its rooms. Clients joining later get it until it
+// expires.
+func (s *Server) createAnnouncementHandler(c echo.Context) error {
+	var req announcementRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	switch {
+	case req.ExpiresAt != "":
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "expires_at must be an RFC 3339 time")
+		}
+		expiresAt = t
+	case req.ExpiresIn != "":
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "expires_in must be a duration such as 2h")
+		}
+		expiresAt = time.Now().Add(d)
+	}
+	if req.Severity == "" {
+		req.Severity = services.SeverityInfo
+	}
+
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	ctx := c.Request().Context()
+	a, err := s.announcementSvc.Create(ctx, services.CreateAnnouncementParams{
+		Severity:  req.Severity,
+		Content:   strings.TrimSpace(req.Content),
+		ExpiresAt: expiresAt,
+		RoomIDs:   req.Rooms,
+		CreatedBy: claims["user_id"].(string),
+	})
+	if errors.Is(err, services.ErrInvalidAnnouncement) {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Println("Error creating announcement", err)
+		return err
+	}
+
+	announcement := ws.Announcement{
+		ID:        a.ID,
+		Severity:  a.Severity,
+		Content:   a.Content,
+		CreatedAt: a.CreatedAt.Time,
+		ExpiresAt: a.ExpiresAt,
+		Scoped:    len(req.Rooms) > 0,
+	}
+	// it is stored, so clients still get it when they next join a room
+	if err := s.roomManager.Announce(ctx, announcement, req.Rooms); err != nil {
+		log.Println("Error pushing announcement", a.ID, err)
+	}
+	return c.JSON(http.StatusCreated, announcement)
+}
+
 // NOTE: create room here
 func (s *Server) createRoomHandler(c echo.Context) error {
 	name := c.FormValue("name")
@@ -206,6 +432,9 @@ func (s *Server) deleteRoomHandler(c echo.Context) error {
 		}
 		return nil
 	}
+	if err := s.roomManager.RemoveRoom(c.Request().Context(), id); err != nil {
+		log.Println("Error closing room hub", id, err)
+	}
 
 	return toast.Toast(toast.Props{
 		Title:         "Delete",
@@ -219,7 +448,10 @@ func (s *Server) deleteRoomHandler(c echo.Context) error {
 func (s *Server) editRoomHandler(c echo.Context) error {
 	id := c.Param("id")
 	name := c.FormValue("name")
-	err := s.roomSvc.Update(c.Request().Context(), id, name)
+	room, err := s.roomSvc.Get(c.Request().Context(), id)
+	if err == nil {
+		err = s.roomSvc.Update(c.Request().Context(), id, name)
+	}
 	if err != nil {
 		return toast.Toast(toast.Props{
 			Title:       "Room",
@@ -227,6 +459,15 @@ func (s *Server) editRoomHandler(c echo.Context) error {
 			Variant:     toast.VariantError,
 		}).Render(c.Request().Context(), c.Response())
 	}
+	if name != room.Name {
+		user := c.Get("user").(*jwt.Token)
+		claims := user.Claims.(jwt.MapClaims)
+		userID := claims["user_id"].(string)
+		email := claims["email"].(string)
+		if err := s.roomManager.RecordEvent(c.Request().Context(), id, userID, email, email+" renamed the room to "+name); err != nil {
+			log.Println("Error recording room rename", id, err)
+		}
+	}
 	if err := toast.Toast(toast.Props{
 		Title:       "Room",
 		Description: "Success",
@@ -262,7 +503,15 @@ func (s *Server) getChatRoomHanlder(c echo.Context) error {
 			Variant:     toast.VariantError,
 		}).Render(c.Request().Context(), c.Response())
 	}
-	msgs, err := s.messageSvc.ListFirst(c.Request().Context(), id)
+	// ?message= opens the page ending at that message rather than the
+	// newest; the live connection then replays what came after it
+	var msgs []repository.GetInitalMessagesRow
+	if messageID := c.QueryParam("message"); messageID != "" {
+		msgs, err = s.messageSvc.ListUpTo(c.Request().Context(), id, userID, messageID)
+	}
+	if err == nil && len(msgs) == 0 {
+		msgs, err = s.messageSvc.ListFirst(c.Request().Context(), id, userID)
+	}
 	if err != nil {
 		c.Response().WriteHeader(http.StatusInternalServerError)
 		return toast.Toast(toast.Props{
@@ -273,7 +522,8 @@ func (s *Server) getChatRoomHanlder(c echo.Context) error {
 	}
 	c.Response().Header().Set("HX-Redirect", "/dashboard/"+id)
 
-	if err := web.Render(c, http.StatusOK, web.ChatRoom(&room, userID, email, msgs)); err != nil {
+	sse := c.QueryParam("transport") == "sse"
+	if err := web.Render(c, http.StatusOK, web.ChatRoom(&room, userID, email, msgs, sse)); err != nil {
 		c.Response().WriteHeader(http.StatusInternalServerError)
 		return toast.Toast(toast.Props{
 			Title:       "Room",
@@ -295,7 +545,10 @@ func (s *Server) getMoreMessagesHandler(c echo.Context) error {
 		log.Println("error converting time", err)
 		return err
 	}
-	msgs, listErr := s.messageSvc.ListNext(c.Request().Context(), roomID, sql.NullTime{Time: ca, Valid: true})
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	userID := claims["user_id"].(string)
+	msgs, listErr := s.messageSvc.ListNext(c.Request().Context(), roomID, userID, sql.NullTime{Time: ca, Valid: true})
 	log.Println("Messages:")
 	fmt.Printf("%-5s | %-30s | %-25s\n", "Index", "Content", "CreatedAt")
 	fmt.Println(strings.Repeat("-", 70))
@@ -308,10 +561,240 @@ func (s *Server) getMoreMessagesHandler(c echo.Context) error {
 	if listErr != nil {
 		return listErr
 	}
+	return web.Render(c, http.StatusOK, web.OlderMessages(msgs, userID))
+}
+
+type threadPage struct {
+	Message ws.ChatMessage   `json:"message"`
+	Replies []ws.ChatMessage `json:"replies"`
+	// Next is the after cursor of the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// getThreadHandler lists the replies in a thread, oldest first, a page at
+// a time: ?after= is the last reply of the previous page. The first page
+// comes in the thread panel along with the thread's first message.
+func (s *Server) getThreadHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	roomID, messageID := c.Param("roomID"), c.Param("messageID")
+	after := c.QueryParam("after")
+	root, err := s.messageSvc.ThreadRoot(ctx, roomID, messageID)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Println("Error getting thread", err)
+		return err
+	}
+	replies, err := s.messageSvc.ListReplies(ctx, roomID, messageID, after, utils.MessagesLimit)
+	if err != nil {
+		log.Println("Error listing replies", err)
+		return err
+	}
+
+	if strings.Contains(c.Request().Header.Get("Accept"), echo.MIMEApplicationJSON) {
+		page := threadPage{
+			Message: ws.ChatMessage{
+				ID:          root.MessageID,
+				RoomID:      root.RoomID,
+				SenderID:    root.UserID,
+				Email:       root.UserEmail,
+				Content:     root.Content,
+				CreatedAt:   root.CreatedAt.Time,
+				Kind:        root.Kind,
+				EditedAt:    nullTime(root.EditedAt),
+				DeletedAt:   nullTime(root.DeletedAt),
+				ReplyCount:  root.ReplyCount,
+				LastReplyAt: nullTime(root.LastReplyAt),
+			},
+			Replies: make([]ws.ChatMessage, 0, len(replies)),
+		}
+		for _, r := range replies {
+			page.Replies = append(page.Replies, ws.ChatMessage{
+				ID:        r.MessageID,
+				RoomID:    r.RoomID,
+				SenderID:  r.UserID,
+				Email:     r.UserEmail,
+				Content:   r.Content,
+				CreatedAt: r.CreatedAt.Time,
+				Kind:      r.Kind,
+				EditedAt:  nullTime(r.EditedAt),
+				DeletedAt: nullTime(r.DeletedAt),
+				ParentID:  messageID,
+			})
+		}
+		if len(replies) >= utils.MessagesLimit {
+			page.Next = replies[len(replies)-1].MessageID
+		}
+		return c.JSON(http.StatusOK, page)
+	}
+
 	user := c.Get("user").(*jwt.Token)
 	claims := user.Claims.(jwt.MapClaims)
 	userID := claims["user_id"].(string)
-	return web.Render(c, http.StatusOK, web.OlderMessages(msgs, userID))
+	if after != "" {
+		return web.Render(c, http.StatusOK, web.ThreadReplies(roomID, messageID, replies, userID))
+	}
+	return web.Render(c, http.StatusOK, web.Thread(root, replies, userID))
+}
+
+// nullTime is t as an optional JSON time.
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// inboxLimit is the most unread mentions the inbox lists.
+const inboxLimit = 50
+
+type inboxMention struct {
+	MessageID string    `json:"message_id"`
+	RoomID    string    `json:"room_id"`
+	RoomName  string    `json:"room_name"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	SenderID  string    `json:"sender_id"`
+	Email     string    `json:"email"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// getInboxHandler lists the user's unread mentions, newest first.
+func (s *Server) getInboxHandler(c echo.Context) error {
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	userID := claims["user_id"].(string)
+
+	mentions, err := s.messageSvc.UnreadMentions(c.Request().Context(), userID, inboxLimit)
+	if err != nil {
+		log.Println("Error listing mentions", err)
+		return err
+	}
+	if strings.Contains(c.Request().Header.Get("Accept"), echo.MIMEApplicationJSON) {
+		inbox := make([]inboxMention, 0, len(mentions))
+		for _, m := range mentions {
+			inbox = append(inbox, inboxMention{
+				MessageID: m.MessageID,
+				RoomID:    m.RoomID,
+				RoomName:  m.RoomName,
+				ParentID:  m.ParentID.String,
+				SenderID:  m.SenderID,
+				Email:     m.SenderEmail,
+				Content:   m.Content,
+				CreatedAt: m.CreatedAt.Time,
+			})
+		}
+		return c.JSON(http.StatusOK, inbox)
+	}
+	return web.Render(c, http.StatusOK, web.Inbox(mentions))
+}
+
+// jumpToMentionHandler marks a mention as read and redirects to the
+// message in its room, or to the first message of its thread for a reply.
+// It takes a POST so that following or prefetching a link reads nothing.
+func (s *Server) jumpToMentionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	userID := claims["user_id"].(string)
+
+	mention, err := s.messageSvc.ReadMention(ctx, userID, c.Param("messageID"))
+	if errors.Is(err, services.ErrMentionNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		log.Println("Error reading mention", err)
+		return err
+	}
+	anchor := mention.MessageID
+	if msg, err := s.messageSvc.Get(ctx, mention.RoomID, mention.MessageID); err == nil && msg.ParentID.Valid {
+		anchor = msg.ParentID.String
+	}
+	return c.Redirect(http.StatusSeeOther, "/dashboard/"+mention.RoomID+"?message="+anchor+"#message-"+anchor)
+}
+
+func (s *Server) readAllMentionsHandler(c echo.Context) error {
+	user := c.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	userID := claims["user_id"].(string)
+
+	if err := s.messageSvc.ReadAllMentions(c.Request().Context(), userID); err != nil {
+		log.Println("Error reading mentions", err)
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/dashboard/inbox")
+}
+
+// membersLimit is the most members suggested for a mention.
+const membersLimit = 10
+
+// mentionTyped is the @ being typed at the end of a chat input.
+var mentionTyped = regexp.MustCompile(`(?:^|\s)@([\w.+@-]*)$`)
+
+type roomMember struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// getMembersHandler autocompletes mentions: it lists the members of a room
+// whose name or email starts with ?q=. Without q, the chat input is sent
+// as chat_message instead, and members are suggested only while it ends
+// in a mention being typed.
+func (s *Server) getMembersHandler(c echo.Context) error {
+	prefix := c.QueryParam("q")
+	if !c.QueryParams().Has("q") {
+		m := mentionTyped.FindStringSubmatch(c.QueryParam("chat_message"))
+		if m == nil {
+			return web.Render(c, http.StatusOK, web.MemberSuggestions(nil))
+		}
+		prefix = m[1]
+	}
+	members, err := s.roomSvc.Members(c.Request().Context(), c.Param("roomID"), prefix, membersLimit)
+	if err != nil {
+		log.Println("Error listing room members", err)
+		return err
+	}
+	if strings.Contains(c.Request().Header.Get("Accept"), echo.MIMEApplicationJSON) {
+		list := make([]roomMember, 0, len(members))
+		for _, m := range members {
+			list = append(list, roomMember{ID: m.ID, Name: m.Name, Email: m.Email})
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+	return web.Render(c, http.StatusOK, web.MemberSuggestions(members))
+}
+
+// roomHub returns the live hub of an existing room. Every realtime
+// transport (websocket, SSE and its companion POST) goes through it.
+func (s *Server) roomHub(c echo.Context, roomID string) (*ws.Room, error) {
+	room, err := s.roomManager.Open(c.Request().Context(), roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "room not found")
+	}
+	if errors.Is(err, ws.ErrShuttingDown) {
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	return room, err
+}
+
+func (s *Server) getPresenceHandler(c echo.Context) error {
+	roomID := c.Param("roomID")
+	members, err := s.roomManager.Presence(c.Request().Context(), roomID)
+	if err != nil {
+		log.Println("Error listing room presence", err)
+		return err
+	}
+	if strings.Contains(c.Request().Header.Get("Accept"), echo.MIMEApplicationJSON) {
+		return c.JSON(http.StatusOK, members)
+	}
+
+	users := make([]web.OnlineUser, 0, len(members))
+	for _, m := range members {
+		users = append(users, web.OnlineUser{UserID: m.UserID, Email: m.Email})
+	}
+	return web.Render(c, http.StatusOK, web.OnlineUsers(users))
 }
 
 func (s *Server) authHandler(c echo.Context) error {
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"expvar"
 	"net/http"
 	"os"
 
@@ -46,16 +47,19 @@ func (s *Server) RegisterRoutes() http.Handler {
 		auth.POST("/logout", s.logOutHandler)
 	}
 
+	requireLogin := echojwt.WithConfig(echojwt.Config{
+		TokenLookup: "header:Authorization:Bearer ,cookie:jwt_token",
+		SigningKey:  []byte(os.Getenv("JWT_SECRET")),
+		ErrorHandler: func(c echo.Context, err error) error {
+			return c.Redirect(http.StatusFound, "/auth")
+		},
+	})
+
 	d := e.Group("/dashboard")
 	{
 
-		d.Use(echojwt.WithConfig(echojwt.Config{
-			TokenLookup: "header:Authorization:Bearer ,cookie:jwt_token",
-			SigningKey:  []byte(os.Getenv("JWT_SECRET")),
-			ErrorHandler: func(c echo.Context, err error) error {
-				return c.Redirect(http.StatusFound, "/auth")
-			},
-		}))
+		d.Use(requireLogin)
+		d.Use(s.rejectRevoked)
 
 		// d.GET("", echo.WrapHandler(templ.Handler(web.DashBoard())))
 		// d.GET("", echo.WrapHandler(templ.Handler(web.DashBoard())))
@@ -66,20 +70,17 @@ func (s *Server) RegisterRoutes() http.Handler {
 		d.GET("/room-edit/:id", s.getEditRoomForm)
 		d.GET("/room-row/:id", s.getRoomRow)
 
-		roomManager := ws.NewRoomManager(s.messageSvc)
-
 		// NOTE: Room chat UI
-		d.GET("/:id", func(c echo.Context) error {
-			roomID := c.Param("id")
-
-			// If room doesn't exits, init a room, create a running ws
-			// The newly created room will be valid to access for ws in /chatroom/:id
-			roomManager.GetRoom(roomID)
-
-			return s.getChatRoomHanlder(c)
-		})
+		d.GET("/:id", s.getChatRoomHanlder)
 
 		d.GET("/room/:roomID/messages", s.getMoreMessagesHandler)
+		d.GET("/room/:roomID/presence", s.getPresenceHandler)
+		d.GET("/room/:roomID/messages/:messageID/revisions", s.getRevisionsHandler, s.requireModerator)
+		d.GET("/room/:roomID/messages/:messageID/thread", s.getThreadHandler)
+		d.GET("/room/:roomID/members", s.getMembersHandler)
+		d.GET("/inbox", s.getInboxHandler)
+		d.POST("/inbox/:messageID", s.jumpToMentionHandler)
+		d.POST("/inbox/read", s.readAllMentionsHandler)
 		d.GET("/api/room", s.getAllRoomHandler)
 
 		d.POST("/api/room", s.createRoomHandler)
@@ -87,18 +88,54 @@ func (s *Server) RegisterRoutes() http.Handler {
 		d.PATCH("/api/room/:id", s.editRoomHandler)
 
 		d.DELETE("/api/room", s.deleteRoomHandler)
+		d.DELETE("/api/room/:roomID/messages/:messageID", s.purgeMessageHandler, s.requireAdmin)
+
+		d.POST("/api/announcements", s.createAnnouncementHandler, s.requireAdmin)
 
 		d.GET("/chatroom/:id", func(c echo.Context) error {
-			roomID := c.Param("id")
-			room := roomManager.GetRoom(roomID)
+			room, err := s.roomHub(c, c.Param("id"))
+			if err != nil {
+				return err
+			}
 			return ws.ServeWs(room, c)
 		})
+
+		// NOTE: One socket for many rooms, e.g. unread badges in the room list
+		d.GET("/ws", func(c echo.Context) error {
+			return ws.ServeMultiplexed(s.roomManager, c)
+		})
+
+		// NOTE: SSE fallback for clients that can't open a websocket
+		d.GET("/room/:roomID/events", func(c echo.Context) error {
+			room, err := s.roomHub(c, c.Param("roomID"))
+			if err != nil {
+				return err
+			}
+			return ws.ServeSSE(room, c)
+		})
+		d.POST("/room/:roomID/messages", func(c echo.Context) error {
+			room, err := s.roomHub(c, c.Param("roomID"))
+			if err != nil {
+				return err
+			}
+			return ws.PostMessage(room, c)
+		})
+		d.PATCH("/room/:roomID/messages/:messageID", func(c echo.Context) error {
+			room, err := s.roomHub(c, c.Param("roomID"))
+			if err != nil {
+				return err
+			}
+			return ws.EditMessage(room, c)
+		})
 	}
 
 	e.GET("/", s.HelloWorldHandler)
 
 	e.GET("/health", s.healthHandler)
 
+	// NOTE: memstats, cmdline and the chat counters are for admins only
+	e.GET("/debug/vars", echo.WrapHandler(expvar.Handler()), requireLogin, s.rejectRevoked, s.requireAdmin)
+
 	e.GET("/websocket", s.websocketHandler)
 
 	return e
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,6 +15,7 @@ import (
 	"rplatform-echo/internal/database"
 	"rplatform-echo/internal/repository"
 	"rplatform-echo/internal/services"
+	"rplatform-echo/internal/ws"
 )
 
 type Server struct {
@@ -21,9 +24,23 @@ type Server struct {
 	db         database.Service
 	roomSvc    *services.RoomService
 	messageSvc *services.MessageService
+	// messageWriter group commits chat messages
+	messageWriter *services.MessageWriter
+	tokenSvc      *services.TokenService
+	// announcementSvc stores admin announcements
+	announcementSvc *services.AnnouncementService
+	// admins are the emails allowed to make announcements
+	admins map[string]bool
+	// moderators may review message history, as may admins
+	moderators map[string]bool
+
+	broker      ws.Broker
+	roomManager *ws.RoomManager
 }
 
-func NewServer() *http.Server {
+// NewServer builds the HTTP server, along with the function that drains the
+// chat rooms on shutdown.
+func NewServer() (*http.Server, func(context.Context) error) {
 	port, _ := strconv.Atoi(os.Getenv("PORT"))
 
 	db := database.New()
@@ -35,13 +52,33 @@ func NewServer() *http.Server {
 	// Wire repository and services
 	repo := repository.New(db.GetDB())
 	roomSvc := services.NewRoomService(repo)
-	messageSvc := services.NewMessageService(repo)
+	messageWriter := services.NewMessageWriter(db.GetDB(), messageWriterConfig())
+	messageSvc := services.NewMessageService(db.GetDB(), repo, messageWriter)
+	tokenSvc := services.NewTokenService(repo)
+	announcementSvc := services.NewAnnouncementService(db.GetDB(), repo)
+
+	// Pick how room broadcasts reach other instances
+	var broker ws.Broker = ws.NewMemoryBroker()
+	if os.Getenv("WS_BROKER") == "sqlite" {
+		sqliteBroker, err := ws.NewSQLiteBroker(repo)
+		if err != nil {
+			log.Fatalf("Failed to start sqlite broker: %v", err)
+		}
+		broker = sqliteBroker
+	}
 
 	NewServer := &Server{
-		port:       port,
-		db:         db,
-		roomSvc:    roomSvc,
-		messageSvc: messageSvc,
+		port:            port,
+		db:              db,
+		roomSvc:         roomSvc,
+		messageSvc:      messageSvc,
+		messageWriter:   messageWriter,
+		tokenSvc:        tokenSvc,
+		announcementSvc: announcementSvc,
+		admins:          adminEmails(),
+		moderators:      moderatorEmails(),
+		broker:          broker,
+		roomManager:     ws.NewRoomManager(context.Background(), roomSvc, messageSvc, tokenSvc, announcementSvc, broker, wsConfig()),
 	}
 
 	// Declare Server config
@@ -53,5 +90,14 @@ func NewServer() *http.Server {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	return server
+	return server, NewServer.Shutdown
+}
+
+// Shutdown drains the chat rooms, closing every socket with a reconnect
+// hint, stores the messages still queued, then stops the broker. Call it
+// before http.Server.Shutdown, which would otherwise wait for the SSE
+// streams.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.roomManager.Shutdown(ctx)
+	return errors.Join(err, s.messageWriter.Close(ctx), s.broker.Close())
 }
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"rplatform-echo/internal/repository"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Announcement severities, from least to most urgent.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// ErrInvalidAnnouncement wraps the reasons Create refuses an announcement.
+var ErrInvalidAnnouncement = errors.New("invalid announcement")
+
+// MaxAnnouncementLength is the most characters an announcement may have.
+const MaxAnnouncementLength = 500
+
+// AnnouncementService stores the announcements admins make to everyone, or
+// to the members of some rooms, until they expire.
+type AnnouncementService struct {
+	db *sql.DB
+	q  *repository.Queries
+}
+
+func NewAnnouncementService(db *sql.DB, q *repository.Queries) *AnnouncementService {
+	return &AnnouncementService{db: db, q: q}
+}
+
+// CreateAnnouncementParams is what an admin announces. An announcement
+// without RoomIDs is for every room.
+type CreateAnnouncementParams struct {
+	Severity  string
+	Content   string
+	ExpiresAt time.Time
+	RoomIDs   []string
+	CreatedBy string
+}
+
+// Create validates and stores an announcement along with its rooms, which
+// must exist.
+func (s *AnnouncementService) Create(ctx context.Context, arg CreateAnnouncementParams) (repository.Announcement, error) {
+	switch arg.Severity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return repository.Announcement{}, fmt.Errorf("%w: severity must be %s, %s or %s", ErrInvalidAnnouncement, SeverityInfo, SeverityWarning, SeverityCritical)
+	}
+	if arg.Content == "" {
+		return repository.Announcement{}, fmt.Errorf("%w: content is required", ErrInvalidAnnouncement)
+	}
+	if utf8.RuneCountInString(arg.Content) > MaxAnnouncementLength {
+		return repository.Announcement{}, fmt.Errorf("%w: content exceeds %d characters", ErrInvalidAnnouncement, MaxAnnouncementLength)
+	}
+	if !arg.ExpiresAt.After(time.Now()) {
+		return repository.Announcement{}, fmt.Errorf("%w: expiry must be in the future", ErrInvalidAnnouncement)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return repository.Announcement{}, err
+	}
+	defer tx.Rollback()
+
+	q := s.q.WithTx(tx)
+	a, err := q.CreateAnnouncement(ctx, repository.CreateAnnouncementParams{
+		ID:        ulid.Make().String(),
+		Severity:  arg.Severity,
+		Content:   arg.Content,
+		CreatedBy: arg.CreatedBy,
+		ExpiresAt: arg.ExpiresAt.UTC(),
+	})
+	if err != nil {
+		return repository.Announcement{}, err
+	}
+	for _, roomID := range arg.RoomIDs {
+		if _, err := q.GetRoom(ctx, roomID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return repository.Announcement{}, fmt.Errorf("%w: room %s not found", ErrInvalidAnnouncement, roomID)
+			}
+			return repository.Announcement{}, err
+		}
+		if err := q.AddAnnouncementRoom(ctx, repository.AddAnnouncementRoomParams{AnnouncementID: a.ID, RoomID: roomID}); err != nil {
+			return repository.Announcement{}, err
+		}
+	}
+	return a, tx.Commit()
+}
+
+// Active returns the announcements that haven't expired for a room, oldest
+// first. An empty roomID returns the ones for every room only.
+func (s *AnnouncementService) Active(ctx context.Context, roomID string) ([]repository.GetActiveAnnouncementsRow, error) {
+	return s.q.GetActiveAnnouncements(ctx, repository.GetActiveAnnouncementsParams{
+		Now:    time.Now().UTC(),
+		RoomID: roomID,
+	})
+}
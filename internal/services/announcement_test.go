@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"rplatform-echo/internal/repository"
+)
+
+func TestAnnouncementService(t *testing.T) {
+	db := openDB(t)
+	q := repository.New(db)
+	svc := NewAnnouncementService(db, q)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u": "u@x"}, map[string]string{"r1": "one", "r2": "two"})
+
+	create := func(content string, expiresIn time.Duration, rooms ...string) {
+		t.Helper()
+		_, err := svc.Create(ctx, CreateAnnouncementParams{
+			Severity:  SeverityWarning,
+			Content:   content,
+			ExpiresAt: time.Now().Add(expiresIn),
+			RoomIDs:   rooms,
+			CreatedBy: "u",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	create("everyone", time.Hour)
+	create("room one", time.Hour, "r1")
+	create("soon over", 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	active := func(roomID string) []string {
+		t.Helper()
+		rows, err := svc.Active(ctx, roomID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var contents []string
+		for _, r := range rows {
+			contents = append(contents, r.Content)
+		}
+		return contents
+	}
+	for roomID, want := range map[string]string{"r1": "[everyone room one]", "r2": "[everyone]", "": "[everyone]"} {
+		if got := fmt.Sprint(active(roomID)); got != want {
+			t.Errorf("Active(%q) = %s, want %s", roomID, got, want)
+		}
+	}
+
+	if _, err := svc.Create(ctx, CreateAnnouncementParams{Severity: "loud", Content: "x", ExpiresAt: time.Now().Add(time.Hour), CreatedBy: "u"}); !errors.Is(err, ErrInvalidAnnouncement) {
+		t.Error("created an announcement with an unknown severity")
+	}
+	if _, err := svc.Create(ctx, CreateAnnouncementParams{Severity: SeverityInfo, Content: "x", ExpiresAt: time.Now().Add(time.Hour), RoomIDs: []string{"nope"}, CreatedBy: "u"}); !errors.Is(err, ErrInvalidAnnouncement) {
+		t.Error("created an announcement for a room that doesn't exist")
+	}
+	if got := fmt.Sprint(active("")); got != "[everyone]" {
+		t.Errorf("a failed announcement was stored: %s", got)
+	}
+}
@@ -0,0 +1,22 @@
+package services
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// seed stores users, by id and email, and rooms, by id and name, for the
+// rows under test to refer to. Users are named after their email.
+func seed(t testing.TB, db *sql.DB, users map[string]string, rooms map[string]string) {
+	t.Helper()
+	for id, email := range users {
+		if _, err := db.Exec(`insert into users (id, name, email, password) values (?, ?, ?, 'pw')`, id, email, email); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, name := range rooms {
+		if _, err := db.Exec(`insert into rooms (id, name) values (?, ?)`, id, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"rplatform-echo/internal/repository"
+)
+
+// maxMentions is the most users one message notifies.
+const maxMentions = 10
+
+// mentionPattern matches an @ starting a word, followed by a handle: a
+// user's name, email, or the part of their email before the @.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w.+@-])@([\w.+-]+(?:@[\w-]+(?:\.[\w-]+)*)?)`)
+
+// ErrMentionNotFound is returned for a message that doesn't mention the
+// user.
+var ErrMentionNotFound = errors.New("mention not found")
+
+// parseMentions returns the distinct handles mentioned in content, in the
+// order they appear.
+func parseMentions(content string) []string {
+	var handles []string
+	seen := make(map[string]bool)
+	for _, m := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// a sentence may end right after the handle
+		handle := strings.TrimRight(m[1], ".")
+		key := strings.ToLower(handle)
+		if handle == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		handles = append(handles, handle)
+		if len(handles) == maxMentions {
+			break
+		}
+	}
+	return handles
+}
+
+// resolveMention returns the user a handle names, preferring one whose
+// name or email it is over one whose email merely starts with it. A
+// handle several users' emails start with names nobody.
+func (m *MessageService) resolveMention(ctx context.Context, handle string) (string, bool, error) {
+	users, err := m.q.FindUsersByHandle(ctx, handle)
+	if err != nil {
+		return "", false, err
+	}
+	var partial []string
+	for _, u := range users {
+		if strings.EqualFold(u.Name, handle) || strings.EqualFold(u.Email, handle) {
+			return u.ID, true, nil
+		}
+		partial = append(partial, u.ID)
+	}
+	if len(partial) != 1 {
+		return "", false, nil
+	}
+	return partial[0], true, nil
+}
+
+// mentionedUsers returns the ids of the users the content of msg
+// mentions, other than its author.
+func (m *MessageService) mentionedUsers(ctx context.Context, msg repository.Message) ([]string, error) {
+	var userIDs []string
+	for _, handle := range parseMentions(msg.Content) {
+		userID, ok, err := m.resolveMention(ctx, handle)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || userID == msg.UserID || slices.Contains(userIDs, userID) {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// saveMentions stores who a message mentions. The mentions of an edited
+// message its content no longer makes are removed, the others keep
+// whether they were read.
+func (m *MessageService) saveMentions(ctx context.Context, msg repository.Message, edited bool) error {
+	userIDs, err := m.mentionedUsers(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if edited {
+		previous, err := m.q.ListMessageMentions(ctx, msg.ID)
+		if err != nil {
+			return err
+		}
+		for _, userID := range previous {
+			if slices.Contains(userIDs, userID) {
+				continue
+			}
+			if err := m.q.DeleteMention(ctx, repository.DeleteMentionParams{
+				MessageID: msg.ID,
+				UserID:    userID,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	for _, userID := range userIDs {
+		if err := m.q.AddMention(ctx, repository.AddMentionParams{
+			MessageID: msg.ID,
+			UserID:    userID,
+			RoomID:    msg.RoomID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeMentions saves the mentions of a message just stored or edited.
+// Failing to does not fail the message.
+func (m *MessageService) storeMentions(ctx context.Context, msg repository.Message, edited bool) {
+	if err := m.saveMentions(ctx, msg, edited); err != nil {
+		log.Println("Error saving mentions of message", msg.ID, err)
+	}
+}
+
+// Mentioned returns the ids of the users a message mentions.
+func (m *MessageService) Mentioned(ctx context.Context, messageID string) ([]string, error) {
+	return m.q.ListMessageMentions(ctx, messageID)
+}
+
+// UnreadMentions returns up to limit of the messages mentioning userID
+// that it hasn't read yet, newest first. Deleted messages are left out.
+func (m *MessageService) UnreadMentions(ctx context.Context, userID string, limit int) ([]repository.ListUnreadMentionsRow, error) {
+	return m.q.ListUnreadMentions(ctx, repository.ListUnreadMentionsParams{
+		UserID: userID,
+		Limit:  int64(limit),
+	})
+}
+
+// ReadMention marks userID's mention in a message as read and returns it.
+func (m *MessageService) ReadMention(ctx context.Context, userID string, messageID string) (repository.Mention, error) {
+	mention, err := m.q.ReadMention(ctx, repository.ReadMentionParams{
+		MessageID: messageID,
+		UserID:    userID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.Mention{}, ErrMentionNotFound
+	}
+	return mention, err
+}
+
+// ReadAllMentions marks every mention of userID as read.
+func (m *MessageService) ReadAllMentions(ctx context.Context, userID string) error {
+	return m.q.ReadAllMentions(ctx, userID)
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"rplatform-echo/internal/repository"
+)
+
+func TestParseMentions(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		want    []string
+	}{
+		{"no mentions here", nil},
+		{"@ann hi", []string{"ann"}},
+		{"hi @ann and @Bob.", []string{"ann", "Bob"}},
+		{"ping @ann@example.com, @ann again @ANN", []string{"ann@example.com", "ann"}},
+		{"mail ann@example.com", nil},
+		{"(@ann)", []string{"ann"}},
+	} {
+		if got := parseMentions(tc.content); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseMentions(%q) = %q, want %q", tc.content, got, tc.want)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	db := openDB(t)
+	svc := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "u1@x", "u2": "ann@x", "u3": "bob@x", "u4": "bob@y"}, map[string]string{"r1": "one"})
+	// bob is ambiguous, ann and u1 (the author) are not
+	msg, err := svc.Create(ctx, "r1", "u1", "", "@ann @bob @bob@y @u1 @nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := svc.Mentioned(ctx, msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"u2", "u4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Mentioned = %v, want %v", got, want)
+	}
+
+	root, err := svc.Create(ctx, "r1", "u3", "", "thread")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := svc.CreateReply(ctx, "r1", "u3", "", root.ID, "what do you think @ANN?", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inbox, err := svc.UnreadMentions(ctx, "u2", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inbox) != 2 || inbox[0].MessageID != reply.ID || inbox[0].ParentID.String != root.ID || inbox[1].SenderEmail != "u1@x" {
+		t.Fatalf("inbox = %+v, want the reply then the first message", inbox)
+	}
+
+	if _, err := svc.ReadMention(ctx, "u3", msg.ID); !errors.Is(err, ErrMentionNotFound) {
+		t.Errorf("ReadMention of another user's mention = %v, want %v", err, ErrMentionNotFound)
+	}
+	mention, err := svc.ReadMention(ctx, "u2", reply.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mention.RoomID != "r1" || !mention.ReadAt.Valid {
+		t.Errorf("ReadMention = %+v, want it read", mention)
+	}
+
+	// an edit adds and removes mentions, leaving read ones read
+	for _, tc := range []struct {
+		content string
+		want    []string
+	}{
+		{"what do you think @ann, and @u1@x?", []string{"u1", "u2"}},
+		{"what do you think @u1@x?", []string{"u1"}},
+	} {
+		if _, err := svc.Edit(ctx, "r1", "u3", reply.ID, tc.content); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := svc.Mentioned(ctx, reply.ID); err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Mentioned after editing to %q = %v, %v, want %v", tc.content, got, err, tc.want)
+		}
+		if inbox, err := svc.UnreadMentions(ctx, "u2", 10); err != nil || len(inbox) != 1 {
+			t.Errorf("inbox after editing to %q = %+v, %v, want the first message only", tc.content, inbox, err)
+		}
+	}
+	if _, err := svc.Delete(ctx, "r1", "u1", msg.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if inbox, err := svc.UnreadMentions(ctx, "u2", 10); err != nil || len(inbox) != 0 {
+		t.Errorf("inbox after reading and deleting = %+v, %v, want it empty", inbox, err)
+	}
+
+	if err := svc.ReadAllMentions(ctx, "u4"); err != nil {
+		t.Fatal(err)
+	}
+	if inbox, err := svc.UnreadMentions(ctx, "u4", 10); err != nil || len(inbox) != 0 {
+		t.Errorf("inbox after reading all = %+v, %v, want it empty", inbox, err)
+	}
+}
@@ -10,47 +10,406 @@ import (
 	"github.com/oklog/ulid/v2"
 )
 
+// Message kinds: what users write, and the events the server records in a
+// room, such as members joining or the room being renamed.
+const (
+	MessageKindUser   = "user"
+	MessageKindSystem = "system"
+)
+
 type MessageService struct {
-	q *repository.Queries
+	db *sql.DB
+	q  *repository.Queries
+	// writer batches Create into group commits, if set.
+	writer *MessageWriter
 }
 
-func NewMessageService(q *repository.Queries) *MessageService {
+// NewMessageService returns the message service. writer may be nil to
+// store each message in its own transaction.
+func NewMessageService(db *sql.DB, q *repository.Queries, writer *MessageWriter) *MessageService {
 	return &MessageService{
-		q: q,
+		db:     db,
+		q:      q,
+		writer: writer,
 	}
 }
 
-func (m *MessageService) ListFirst(ctx context.Context, roomID string) ([]repository.GetInitalMessagesRow, error) {
-	return m.q.GetInitalMessages(ctx, roomID)
+// ListFirst returns the newest messages of a room, with their reactions as
+// userID sees them.
+func (m *MessageService) ListFirst(ctx context.Context, roomID string, userID string) ([]repository.GetInitalMessagesRow, error) {
+	return m.q.GetInitalMessages(ctx, repository.GetInitalMessagesParams{
+		UserID: userID,
+		RoomID: roomID,
+	})
+}
+
+// ListUpTo returns the page of a room's messages that ends at messageID,
+// newest first, or nothing if the room has no such message.
+func (m *MessageService) ListUpTo(ctx context.Context, roomID string, userID string, messageID string) ([]repository.GetInitalMessagesRow, error) {
+	rows, err := m.q.GetMessagesUpTo(ctx, repository.GetMessagesUpToParams{
+		UserID:    userID,
+		RoomID:    roomID,
+		MessageID: messageID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]repository.GetInitalMessagesRow, len(rows))
+	for i, r := range rows {
+		msgs[i] = repository.GetInitalMessagesRow(r)
+	}
+	return msgs, nil
 }
 
-func (m *MessageService) ListNext(ctx context.Context, roomID string, createdAt sql.NullTime) ([]repository.GetPaginatedMessagesRow, error) {
+// ListNext returns the messages of a room older than createdAt, with their
+// reactions as userID sees them.
+func (m *MessageService) ListNext(ctx context.Context, roomID string, userID string, createdAt sql.NullTime) ([]repository.GetPaginatedMessagesRow, error) {
 	return m.q.GetPaginatedMessages(ctx, repository.GetPaginatedMessagesParams{
+		UserID:   userID,
 		RoomID:   roomID,
 		Datetime: createdAt,
 	})
 }
 
-func (m *MessageService) Create(ctx context.Context, roomID string, userID string, content string) (repository.Message, error) {
+// ListAfter returns up to limit messages of a room newer than afterID, oldest first.
+func (m *MessageService) ListAfter(ctx context.Context, roomID string, afterID string, limit int) ([]repository.GetMessagesAfterRow, error) {
+	return m.q.GetMessagesAfter(ctx, repository.GetMessagesAfterParams{
+		RoomID: roomID,
+		ID:     afterID,
+		Limit:  int64(limit),
+	})
+}
+
+// ErrDuplicateMessage is returned by Create, along with the stored message,
+// when the user already sent a message with the same client id.
+var ErrDuplicateMessage = errors.New("message already stored")
+
+// Create stores a message, and whom its @mentions name. A non-empty
+// clientID makes the call idempotent per user: retries get back the first
+// stored message and ErrDuplicateMessage. With a writer the message is
+// stored in its next group commit.
+func (m *MessageService) Create(ctx context.Context, roomID string, userID string, clientID string, content string) (repository.Message, error) {
+	err := checkValidRequest(roomID, userID)
+	if err != nil {
+		return repository.Message{}, err
+	}
+
+	arg := repository.CreateMessageParams{
+		RoomID:   roomID,
+		UserID:   userID,
+		ID:       ulid.Make().String(),
+		Content:  content,
+		ClientID: sql.NullString{String: clientID, Valid: clientID != ""},
+		Kind:     MessageKindUser,
+	}
+	msg, err := m.create(ctx, arg)
+	if err == nil {
+		m.storeMentions(ctx, msg, false)
+	}
+	return msg, err
+}
+
+// ErrInvalidParent is returned by CreateReply for a parent that can't
+// start a thread: a reply, a deleted message or one of another room.
+var ErrInvalidParent = errors.New("replies must answer a message of the room that isn't a reply")
+
+// CreateReply stores a reply in the thread of parentID, which must be a
+// message of the room outside any thread. Replies stay out of the room's
+// timeline unless alsoInRoom is set. It stores mentions and is idempotent
+// per clientID like Create.
+func (m *MessageService) CreateReply(ctx context.Context, roomID string, userID string, clientID string, parentID string, content string, alsoInRoom bool) (repository.Message, error) {
+	err := checkValidRequest(roomID, userID)
+	if err != nil {
+		return repository.Message{}, err
+	}
+
+	parent, err := m.q.GetMessage(ctx, parentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.Message{}, ErrInvalidParent
+	}
+	if err != nil {
+		return repository.Message{}, err
+	}
+	if parent.RoomID != roomID || parent.ParentID.Valid || parent.DeletedAt.Valid {
+		return repository.Message{}, ErrInvalidParent
+	}
+
+	msg, err := m.create(ctx, repository.CreateMessageParams{
+		RoomID:     roomID,
+		UserID:     userID,
+		ID:         ulid.Make().String(),
+		Content:    content,
+		ClientID:   sql.NullString{String: clientID, Valid: clientID != ""},
+		Kind:       MessageKindUser,
+		ParentID:   sql.NullString{String: parentID, Valid: true},
+		AlsoInRoom: alsoInRoom,
+	})
+	if err == nil {
+		m.storeMentions(ctx, msg, false)
+	}
+	return msg, err
+}
+
+// CreateSystem stores a system event of a room, attributed to the user
+// who caused it.
+func (m *MessageService) CreateSystem(ctx context.Context, roomID string, userID string, content string) (repository.Message, error) {
 	err := checkValidRequest(roomID, userID)
 	if err != nil {
 		return repository.Message{}, err
 	}
 
-	return m.q.CreateMessage(ctx, repository.CreateMessageParams{
+	return m.create(ctx, repository.CreateMessageParams{
 		RoomID:  roomID,
 		UserID:  userID,
 		ID:      ulid.Make().String(),
 		Content: content,
+		Kind:    MessageKindSystem,
 	})
 }
 
-func (m *MessageService) Delete(ctx context.Context, roomID string, userID string, messageID string) error {
-	err := checkValidRequest(roomID, userID)
+func (m *MessageService) create(ctx context.Context, arg repository.CreateMessageParams) (repository.Message, error) {
+	if m.writer != nil {
+		return m.writer.Create(ctx, arg)
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
+		return repository.Message{}, err
+	}
+	defer tx.Rollback()
+
+	msg, err := createMessage(ctx, m.q.WithTx(tx), arg)
+	if err != nil {
+		return msg, err
+	}
+	return msg, tx.Commit()
+}
+
+// createMessage stores a message and counts a reply in its thread. Both
+// go in the caller's transaction, so a failure leaves neither behind.
+func createMessage(ctx context.Context, q *repository.Queries, arg repository.CreateMessageParams) (repository.Message, error) {
+	cid := arg.ClientID
+	if cid.Valid {
+		if msg, err := q.GetMessageByClientID(ctx, repository.GetMessageByClientIDParams{UserID: arg.UserID, ClientID: cid}); err == nil {
+			return msg, ErrDuplicateMessage
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return repository.Message{}, err
+		}
+	}
+
+	msg, err := q.CreateMessage(ctx, arg)
+	if err != nil && cid.Valid {
+		// lost a race with a concurrent retry
+		if dup, dupErr := q.GetMessageByClientID(ctx, repository.GetMessageByClientIDParams{UserID: arg.UserID, ClientID: cid}); dupErr == nil {
+			return dup, ErrDuplicateMessage
+		}
+	}
+	if err == nil && arg.ParentID.Valid {
+		err = q.AddThreadReply(ctx, repository.AddThreadReplyParams{LastReplyAt: msg.CreatedAt, ID: arg.ParentID.String})
+	}
+	return msg, err
+}
+
+// ThreadRoot returns the first message of a thread of the room, with its
+// sender.
+func (m *MessageService) ThreadRoot(ctx context.Context, roomID string, messageID string) (repository.GetThreadRootRow, error) {
+	root, err := m.q.GetThreadRoot(ctx, repository.GetThreadRootParams{ID: messageID, RoomID: roomID})
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.GetThreadRootRow{}, ErrMessageNotFound
+	}
+	return root, err
+}
+
+// ListReplies returns up to limit replies in the thread of parentID newer
+// than afterID, oldest first.
+func (m *MessageService) ListReplies(ctx context.Context, roomID string, parentID string, afterID string, limit int) ([]repository.GetThreadRepliesRow, error) {
+	if _, err := m.ThreadRoot(ctx, roomID, parentID); err != nil {
+		return nil, err
+	}
+	return m.q.GetThreadReplies(ctx, repository.GetThreadRepliesParams{
+		ParentID: sql.NullString{String: parentID, Valid: true},
+		ID:       afterID,
+		Limit:    int64(limit),
+	})
+}
+
+var (
+	// ErrMessageNotFound is returned for a message that isn't in the room.
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrNotAuthor is returned when someone other than the author changes a
+	// message, or anyone changes a system message.
+	ErrNotAuthor = errors.New("only the author can change a message")
+)
+
+// Get returns a message of a room.
+func (m *MessageService) Get(ctx context.Context, roomID string, messageID string) (repository.Message, error) {
+	msg, err := m.q.GetMessage(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && msg.RoomID != roomID) {
+		return repository.Message{}, ErrMessageNotFound
+	}
+	return msg, err
+}
+
+// Edit replaces the content of a message written by userID, keeping the
+// previous version in its revisions, and updates whom it mentions.
+// Content that didn't change is not a new revision.
+func (m *MessageService) Edit(ctx context.Context, roomID string, userID string, messageID string, content string) (repository.Message, error) {
+	if err := checkValidRequest(roomID, userID); err != nil {
+		return repository.Message{}, err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return repository.Message{}, err
+	}
+	defer tx.Rollback()
+
+	q := m.q.WithTx(tx)
+	msg, err := q.GetMessage(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && msg.RoomID != roomID) {
+		return repository.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return repository.Message{}, err
+	}
+	if msg.DeletedAt.Valid {
+		return repository.Message{}, ErrMessageNotFound
+	}
+	if msg.UserID != userID || msg.Kind != MessageKindUser {
+		return repository.Message{}, ErrNotAuthor
+	}
+	if msg.Content == content {
+		return msg, nil
+	}
+
+	if err := saveRevision(ctx, q, msg); err != nil {
+		return repository.Message{}, err
+	}
+	msg, err = q.UpdateMessage(ctx, repository.UpdateMessageParams{Content: content, ID: messageID})
+	if err != nil {
+		return repository.Message{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return repository.Message{}, err
+	}
+	m.storeMentions(ctx, msg, true)
+	return msg, nil
+}
+
+// saveRevision keeps the current content of msg, dated from when it was
+// written.
+func saveRevision(ctx context.Context, q *repository.Queries, msg repository.Message) error {
+	written := msg.CreatedAt.Time
+	if msg.EditedAt.Valid {
+		written = msg.EditedAt.Time
+	}
+	return q.CreateMessageRevision(ctx, repository.CreateMessageRevisionParams{
+		MessageID: msg.ID,
+		Content:   msg.Content,
+		CreatedAt: written.UTC(),
+	})
+}
+
+// Revisions returns the earlier versions of a message, oldest first.
+func (m *MessageService) Revisions(ctx context.Context, roomID string, messageID string) ([]repository.MessageRevision, error) {
+	if _, err := m.Get(ctx, roomID, messageID); err != nil {
+		return nil, err
+	}
+	return m.q.GetMessageRevisions(ctx, messageID)
+}
+
+// Delete replaces a message with a tombstone, keeping its content in the
+// revisions for moderators. Only the author may delete a message, unless
+// moderator is set. Deleting a tombstone again returns it unchanged.
+func (m *MessageService) Delete(ctx context.Context, roomID string, userID string, messageID string, moderator bool) (repository.Message, error) {
+	if err := checkValidRequest(roomID, userID); err != nil {
+		return repository.Message{}, err
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return repository.Message{}, err
+	}
+	defer tx.Rollback()
+
+	q := m.q.WithTx(tx)
+	msg, err := q.GetMessage(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && msg.RoomID != roomID) {
+		return repository.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return repository.Message{}, err
+	}
+	if !moderator && (msg.UserID != userID || msg.Kind != MessageKindUser) {
+		return repository.Message{}, ErrNotAuthor
+	}
+	if msg.DeletedAt.Valid {
+		return msg, nil
+	}
+
+	if err := saveRevision(ctx, q, msg); err != nil {
+		return repository.Message{}, err
+	}
+	msg, err = q.SoftDeleteMessage(ctx, repository.SoftDeleteMessageParams{
+		DeletedBy: sql.NullString{String: userID, Valid: true},
+		ID:        messageID,
+	})
+	if err != nil {
+		return repository.Message{}, err
+	}
+	return msg, tx.Commit()
+}
+
+// Purge removes a message, its revisions, reactions and mentions for good,
+// leaving no tombstone. The replies of a thread go with its root. It
+// returns the ids of the messages removed, the message last.
+func (m *MessageService) Purge(ctx context.Context, roomID string, messageID string) ([]string, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := m.q.WithTx(tx)
+	msg, err := q.GetMessage(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && msg.RoomID != roomID) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	// replies go before the root they refer to
+	var purged []string
+	if !msg.ParentID.Valid {
+		if purged, err = q.GetThreadReplyIDs(ctx, sql.NullString{String: messageID, Valid: true}); err != nil {
+			return nil, err
+		}
+	}
+	purged = append(purged, messageID)
+	for _, id := range purged {
+		if err := purgeMessage(ctx, q, id); err != nil {
+			return nil, err
+		}
+	}
+	if msg.ParentID.Valid {
+		if err := q.RemoveThreadReply(ctx, msg.ParentID.String); err != nil {
+			return nil, err
+		}
+	}
+	return purged, tx.Commit()
+}
+
+func purgeMessage(ctx context.Context, q *repository.Queries, messageID string) error {
+	if err := q.DeleteMessageRevisions(ctx, messageID); err != nil {
+		return err
+	}
+	if err := q.DeleteMessageReactions(ctx, messageID); err != nil {
+		return err
+	}
+	if err := q.DeleteMessageMentions(ctx, messageID); err != nil {
 		return err
 	}
-	return m.q.DeleteMessage(ctx, messageID)
+	return q.DeleteMessage(ctx, messageID)
 }
 
 func checkValidRequest(roomID string, userID string) error {
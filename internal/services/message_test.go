@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"rplatform-echo/internal/repository"
+)
+
+func TestMessageEdit(t *testing.T) {
+	db := openDB(t)
+	svc := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "u1@x", "u2": "u2@x"}, map[string]string{"r1": "one", "r2": "two"})
+	msg, err := svc.Create(ctx, "r1", "u1", "", "helo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := svc.CreateSystem(ctx, "r1", "u1", "u1@x joined the room")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, room, user, id string
+		want                 error
+	}{
+		{"other user", "r1", "u2", msg.ID, ErrNotAuthor},
+		{"system message", "r1", "u1", event.ID, ErrNotAuthor},
+		{"other room", "r2", "u1", msg.ID, ErrMessageNotFound},
+		{"unknown message", "r1", "u1", "nope", ErrMessageNotFound},
+	} {
+		if _, err := svc.Edit(ctx, tc.room, tc.user, tc.id, "x"); !errors.Is(err, tc.want) {
+			t.Errorf("%s: Edit error = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	for _, content := range []string{"hello", "hello", "hello!"} {
+		edited, err := svc.Edit(ctx, "r1", "u1", msg.ID, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if edited.Content != content || !edited.EditedAt.Valid {
+			t.Fatalf("Edit(%q) = %+v", content, edited)
+		}
+	}
+
+	revisions, err := svc.Revisions(ctx, "r1", msg.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unchanged edit is not a revision
+	if len(revisions) != 2 || revisions[0].Content != "helo" || revisions[1].Content != "hello" {
+		t.Errorf("revisions = %+v", revisions)
+	}
+}
+
+func TestMessageDelete(t *testing.T) {
+	db := openDB(t)
+	svc := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "u1@x", "u2": "u2@x"}, map[string]string{"r1": "one"})
+	mine, err := svc.Create(ctx, "r1", "u1", "", "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := svc.Create(ctx, "r1", "u2", "", "theirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.Delete(ctx, "r1", "u1", theirs.ID, false); !errors.Is(err, ErrNotAuthor) {
+		t.Errorf("Delete of another user's message = %v, want %v", err, ErrNotAuthor)
+	}
+	for _, tc := range []struct {
+		user      string
+		id        string
+		moderator bool
+	}{
+		{"u1", mine.ID, false},
+		{"u1", theirs.ID, true},
+	} {
+		deleted, err := svc.Delete(ctx, "r1", tc.user, tc.id, tc.moderator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted.Content != "" || !deleted.DeletedAt.Valid || deleted.DeletedBy.String != tc.user {
+			t.Errorf("Delete(%s) = %+v", tc.id, deleted)
+		}
+	}
+	if _, err := svc.Edit(ctx, "r1", "u1", mine.ID, "back"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Edit of a deleted message = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	msgs, err := svc.ListFirst(ctx, "r1", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || !msgs[0].DeletedAt.Valid || msgs[0].Content != "" {
+		t.Errorf("ListFirst = %+v, want two tombstones", msgs)
+	}
+	revisions, err := svc.Revisions(ctx, "r1", theirs.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Content != "theirs" {
+		t.Errorf("revisions = %+v", revisions)
+	}
+
+	if _, err := svc.Purge(ctx, "r1", theirs.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Get(ctx, "r1", theirs.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Get of a purged message = %v, want %v", err, ErrMessageNotFound)
+	}
+	if revisions, err := svc.q.GetMessageRevisions(ctx, theirs.ID); err != nil || len(revisions) != 0 {
+		t.Errorf("revisions of a purged message = %+v, %v", revisions, err)
+	}
+}
+
+func TestListUpTo(t *testing.T) {
+	db := openDB(t)
+	svc := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "u1@x"}, map[string]string{"r1": "one", "r2": "two"})
+	var ids []string
+	for i := range 20 {
+		msg, err := svc.Create(ctx, "r1", "u1", "", fmt.Sprint(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+
+	msgs, err := svc.ListUpTo(ctx, "r1", "u1", ids[17])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 15 || msgs[0].MessageID != ids[17] || msgs[14].MessageID != ids[3] {
+		t.Errorf("ListUpTo = %+v, want the 15 messages up to %s", msgs, ids[17])
+	}
+	if msgs, err := svc.ListUpTo(ctx, "r2", "u1", ids[17]); err != nil || len(msgs) != 0 {
+		t.Errorf("ListUpTo of another room's message = %+v, %v, want none", msgs, err)
+	}
+}
+
+func TestMessageReplies(t *testing.T) {
+	db := openDB(t)
+	// purging a thread must hold with foreign keys enforced
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec("pragma foreign_keys = on"); err != nil {
+		t.Fatal(err)
+	}
+	svc := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "u1@x"}, map[string]string{"r1": "one", "r2": "two"})
+	root, err := svc.Create(ctx, "r1", "u1", "", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiet, err := svc.CreateReply(ctx, "r1", "u1", "", root.ID, "in thread", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loud, err := svc.CreateReply(ctx, "r1", "u1", "", root.ID, "in thread and room", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ name, room, parent string }{
+		{"reply to a reply", "r1", quiet.ID},
+		{"other room", "r2", root.ID},
+		{"unknown parent", "r1", "nope"},
+	} {
+		if _, err := svc.CreateReply(ctx, tc.room, "u1", "", tc.parent, "x", false); !errors.Is(err, ErrInvalidParent) {
+			t.Errorf("%s: CreateReply error = %v, want %v", tc.name, err, ErrInvalidParent)
+		}
+	}
+
+	root, err = svc.Get(ctx, "r1", root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.ReplyCount != 2 || !root.LastReplyAt.Valid {
+		t.Errorf("root = %+v, want 2 replies", root)
+	}
+
+	msgs, err := svc.ListFirst(ctx, "r1", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || msgs[0].MessageID != loud.ID || msgs[1].MessageID != root.ID {
+		t.Errorf("ListFirst = %+v, want the root and the reply also sent to the room", msgs)
+	}
+
+	page, err := svc.ListReplies(ctx, "r1", root.ID, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].MessageID != quiet.ID {
+		t.Fatalf("first page = %+v", page)
+	}
+	page, err = svc.ListReplies(ctx, "r1", root.ID, page[0].MessageID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].MessageID != loud.ID {
+		t.Errorf("second page = %+v", page)
+	}
+
+	// purging the last reply updates its root, purging the root takes the
+	// rest
+	if _, err := db.Exec(`update messages set created_at = datetime(created_at, '-1 hour') where id = ?`, quiet.ID); err != nil {
+		t.Fatal(err)
+	}
+	if quiet, err = svc.Get(ctx, "r1", quiet.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.Purge(ctx, "r1", loud.ID); err != nil {
+		t.Fatal(err)
+	}
+	root, err = svc.Get(ctx, "r1", root.ID)
+	if err != nil || root.ReplyCount != 1 || !root.LastReplyAt.Time.Equal(quiet.CreatedAt.Time) {
+		t.Errorf("root after purging a reply = %+v, %v, want 1 reply at %v", root, err, quiet.CreatedAt.Time)
+	}
+	purged, err := svc.Purge(ctx, "r1", root.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 2 || purged[0] != quiet.ID || purged[1] != root.ID {
+		t.Errorf("Purge of the root = %v, want its remaining reply and the root", purged)
+	}
+	if _, err := svc.Get(ctx, "r1", quiet.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Get of a reply of a purged root = %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestCreateReplyAtomic(t *testing.T) {
+	db := openDB(t)
+	seed(t, db, map[string]string{"u1": "u1@x"}, map[string]string{"r1": "one"})
+	// counting a reply in this thread fails
+	if _, err := db.Exec(`insert into messages (id, room_id, user_id, content, kind) values ('root', 'r1', 'u1', 'root', 'user');
+		create trigger fail_reply_count before update of reply_count on messages
+		when new.id = 'root' begin select raise(abort, 'no more replies'); end;`); err != nil {
+		t.Fatal(err)
+	}
+	w := NewMessageWriter(db, MessageWriterConfig{QueueSize: 8, FlushInterval: 20 * time.Millisecond, MaxBatch: 8})
+	defer w.Close(context.Background())
+	ctx := context.Background()
+
+	for _, svc := range []*MessageService{
+		NewMessageService(db, repository.New(db), nil),
+		NewMessageService(db, repository.New(db), w),
+	} {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := svc.Create(ctx, "r1", "u1", "", "same batch"); err != nil {
+				t.Error(err)
+			}
+		}()
+		if _, err := svc.CreateReply(ctx, "r1", "u1", "", "root", "reply", false); err == nil {
+			t.Error("CreateReply succeeded without counting the reply")
+		}
+		wg.Wait()
+	}
+
+	var replies, others int
+	if err := db.QueryRow(`select count(*) filter (where parent_id is not null), count(*) filter (where content = 'same batch') from messages`).Scan(&replies, &others); err != nil {
+		t.Fatal(err)
+	}
+	if replies != 0 || others != 2 {
+		t.Errorf("stored %d replies and %d other messages, want none and 2", replies, others)
+	}
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"rplatform-echo/internal/repository"
+)
+
+var (
+	// ErrQueueFull is returned by MessageWriter.Create when the queue is
+	// full; the sender should back off and send again.
+	ErrQueueFull = errors.New("too many messages waiting to be stored")
+	// ErrWriterClosed is returned by MessageWriter.Create after Close.
+	ErrWriterClosed = errors.New("message writer closed")
+)
+
+// MessageWriterConfig sizes the persistence pipeline.
+type MessageWriterConfig struct {
+	// QueueSize is how many messages may wait to be stored before Create
+	// returns ErrQueueFull.
+	QueueSize int
+	// FlushInterval is how long the first message of a batch waits for
+	// others to join it.
+	FlushInterval time.Duration
+	// MaxBatch is the most messages stored in one transaction.
+	MaxBatch int
+}
+
+func DefaultMessageWriterConfig() MessageWriterConfig {
+	return MessageWriterConfig{
+		QueueSize:     1024,
+		FlushInterval: 5 * time.Millisecond,
+		MaxBatch:      128,
+	}
+}
+
+// MessageWriter stores messages from all rooms in group commits: one
+// goroutine collects whatever is queued into a batch and inserts it in a
+// single transaction, so concurrent senders share the cost of a commit.
+type MessageWriter struct {
+	db  *sql.DB
+	cfg MessageWriterConfig
+
+	// mu guards closing the queue against senders still adding to it.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *pendingMessage
+	done   chan struct{}
+}
+
+type pendingMessage struct {
+	arg  repository.CreateMessageParams
+	msg  repository.Message
+	err  error
+	done chan struct{}
+}
+
+func NewMessageWriter(db *sql.DB, cfg MessageWriterConfig) *MessageWriter {
+	w := &MessageWriter{
+		db:    db,
+		cfg:   cfg,
+		queue: make(chan *pendingMessage, cfg.QueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Create queues a message and waits until its batch is committed. It
+// returns ErrQueueFull right away if the queue is full. If ctx is done
+// first the message may still be stored.
+func (w *MessageWriter) Create(ctx context.Context, arg repository.CreateMessageParams) (repository.Message, error) {
+	p := &pendingMessage{arg: arg, done: make(chan struct{})}
+
+	w.mu.RLock()
+	if w.closed {
+		w.mu.RUnlock()
+		return repository.Message{}, ErrWriterClosed
+	}
+	select {
+	case w.queue <- p:
+	default:
+		w.mu.RUnlock()
+		return repository.Message{}, ErrQueueFull
+	}
+	w.mu.RUnlock()
+
+	select {
+	case <-p.done:
+		return p.msg, p.err
+	case <-ctx.Done():
+		return repository.Message{}, ctx.Err()
+	}
+}
+
+// Close stops taking messages and stores everything already queued. It
+// returns ctx's error if that doesn't finish before ctx is done.
+func (w *MessageWriter) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *MessageWriter) run() {
+	defer close(w.done)
+
+	batch := make([]*pendingMessage, 0, w.cfg.MaxBatch)
+	timer := time.NewTimer(w.cfg.FlushInterval)
+	timer.Stop()
+	for {
+		first, ok := <-w.queue
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], first)
+		timer.Reset(w.cfg.FlushInterval)
+	fill:
+		for len(batch) < w.cfg.MaxBatch {
+			select {
+			case p, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, p)
+			case <-timer.C:
+				break fill
+			}
+		}
+		timer.Stop()
+		w.flush(batch)
+	}
+}
+
+// flush stores a batch in one transaction. A message that fails on its
+// own, such as a duplicate, doesn't fail the others.
+func (w *MessageWriter) flush(batch []*pendingMessage) {
+	defer func() {
+		for _, p := range batch {
+			close(p.done)
+		}
+	}()
+
+	ctx := context.Background()
+	tx, err := w.db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Println("Error starting message batch", err)
+		for _, p := range batch {
+			p.err = err
+		}
+		return
+	}
+	q := repository.New(tx)
+	for _, p := range batch {
+		p.msg, p.err = createInBatch(ctx, tx, q, p.arg)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("Error committing message batch", err)
+		for _, p := range batch {
+			if p.err == nil || errors.Is(p.err, ErrDuplicateMessage) {
+				p.msg, p.err = repository.Message{}, err
+			}
+		}
+	}
+}
+
+// createInBatch stores a message of a batch under a savepoint, so that if
+// it fails part way, say after its row but before its thread's count,
+// none of it is committed with the others.
+func createInBatch(ctx context.Context, tx *sql.Tx, q *repository.Queries, arg repository.CreateMessageParams) (repository.Message, error) {
+	if _, err := tx.ExecContext(ctx, "savepoint message"); err != nil {
+		return repository.Message{}, err
+	}
+	msg, err := createMessage(ctx, q, arg)
+	if err != nil && !errors.Is(err, ErrDuplicateMessage) {
+		if _, rbErr := tx.ExecContext(ctx, "rollback to message"); rbErr != nil {
+			return repository.Message{}, errors.Join(err, rbErr)
+		}
+	}
+	if _, relErr := tx.ExecContext(ctx, "release message"); relErr != nil {
+		return repository.Message{}, errors.Join(err, relErr)
+	}
+	return msg, err
+}
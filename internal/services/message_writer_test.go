@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"rplatform-echo/internal/repository"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+)
+
+func openDB(t testing.TB) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "messages.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	goose.SetLogger(goose.NopLogger())
+	if err := goose.SetDialect("sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(db, "../database/migrations"); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMessageWriter(t *testing.T) {
+	db := openDB(t)
+	w := NewMessageWriter(db, MessageWriterConfig{QueueSize: 64, FlushInterval: 20 * time.Millisecond, MaxBatch: 8})
+	svc := NewMessageService(db, repository.New(db), w)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	ids := make(map[string]int)
+	dups := 0
+	for i := range 20 {
+		wg.Go(func() {
+			// two sends of c0 race within a batch
+			cid := fmt.Sprint("c", i%19)
+			msg, err := svc.Create(ctx, "room", "user", cid, "hi")
+			mu.Lock()
+			defer mu.Unlock()
+			if errors.Is(err, ErrDuplicateMessage) {
+				dups++
+			} else if err != nil {
+				t.Errorf("Create() error = %v", err)
+			}
+			ids[msg.ID]++
+		})
+	}
+	wg.Wait()
+	if len(ids) != 19 || dups != 1 {
+		t.Errorf("stored %d messages with %d duplicates, want 19 with 1", len(ids), dups)
+	}
+
+	// Close stores what is still queued
+	done := make(chan error)
+	go func() {
+		_, err := svc.Create(ctx, "room", "user", "last", "bye")
+		done <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Create() queued before Close error = %v", err)
+	}
+	if _, err := svc.Create(ctx, "room", "user", "", "late"); err != ErrWriterClosed {
+		t.Errorf("Create() after Close error = %v, want %v", err, ErrWriterClosed)
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprint("batched=", batched), func(b *testing.B) {
+			db := openDB(b)
+			var w *MessageWriter
+			if batched {
+				w = NewMessageWriter(db, DefaultMessageWriterConfig())
+				defer w.Close(context.Background())
+			}
+			svc := NewMessageService(db, repository.New(db), w)
+
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := svc.Create(context.Background(), "room", "user", "", "hello"); err != nil && !errors.Is(err, ErrQueueFull) {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+
+	"rplatform-echo/internal/repository"
+)
+
+// Most runes in a reaction, enough for skin tones and ZWJ sequences.
+const maxEmojiLength = 10
+
+// ErrInvalidReaction is returned for a reaction that isn't an emoji.
+var ErrInvalidReaction = errors.New("reactions must be a single emoji")
+
+// Reaction is how many users reacted to a message with Emoji, and whether
+// the user listing it is one of them.
+type Reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int64  `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// Reactions decodes the reactions aggregated by the message list queries.
+func Reactions(raw string) []Reaction {
+	var reactions []Reaction
+	if err := json.Unmarshal([]byte(raw), &reactions); err != nil {
+		return nil
+	}
+	return reactions
+}
+
+// ToggleReaction adds userID's emoji reaction to a message, or removes it
+// if it was there. It returns the emoji's new count, with Reacted telling
+// whether the reaction was added.
+func (m *MessageService) ToggleReaction(ctx context.Context, roomID string, userID string, messageID string, emoji string) (Reaction, error) {
+	if err := checkValidRequest(roomID, userID); err != nil {
+		return Reaction{}, err
+	}
+	if !validEmoji(emoji) {
+		return Reaction{}, ErrInvalidReaction
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Reaction{}, err
+	}
+	defer tx.Rollback()
+
+	q := m.q.WithTx(tx)
+	msg, err := q.GetMessage(ctx, messageID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && (msg.RoomID != roomID || msg.DeletedAt.Valid)) {
+		return Reaction{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return Reaction{}, err
+	}
+
+	r := Reaction{Emoji: emoji}
+	removed, err := q.DeleteReaction(ctx, repository.DeleteReactionParams{MessageID: messageID, UserID: userID, Emoji: emoji})
+	if err != nil {
+		return Reaction{}, err
+	}
+	if removed == 0 {
+		if err := q.AddReaction(ctx, repository.AddReactionParams{MessageID: messageID, UserID: userID, Emoji: emoji}); err != nil {
+			return Reaction{}, err
+		}
+		r.Reacted = true
+	}
+	if r.Count, err = q.CountReactions(ctx, repository.CountReactionsParams{MessageID: messageID, Emoji: emoji}); err != nil {
+		return Reaction{}, err
+	}
+	return r, tx.Commit()
+}
+
+// validEmoji accepts a short run of symbols, such as 👍 or 👍🏽, and
+// rejects text.
+func validEmoji(s string) bool {
+	n := utf8.RuneCountInString(s)
+	if n == 0 || n > maxEmojiLength {
+		return false
+	}
+	for _, r := range s {
+		if r < utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
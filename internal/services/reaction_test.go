@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"rplatform-echo/internal/repository"
+)
+
+func TestToggleReaction(t *testing.T) {
+	db := openDB(t)
+	svc := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "u1@x", "u2": "u2@x"}, map[string]string{"r1": "one"})
+	msg, err := svc.Create(ctx, "r1", "u1", "", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, emoji := range []string{"", "ok", "👍 ", "👍👍👍👍👍👍👍👍👍👍👍"} {
+		if _, err := svc.ToggleReaction(ctx, "r1", "u1", msg.ID, emoji); !errors.Is(err, ErrInvalidReaction) {
+			t.Errorf("ToggleReaction(%q) error = %v, want %v", emoji, err, ErrInvalidReaction)
+		}
+	}
+	if _, err := svc.ToggleReaction(ctx, "r1", "u1", "nope", "👍"); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("ToggleReaction of an unknown message = %v, want %v", err, ErrMessageNotFound)
+	}
+
+	for _, tc := range []struct {
+		user, emoji string
+		want        Reaction
+	}{
+		{"u1", "👍", Reaction{Emoji: "👍", Count: 1, Reacted: true}},
+		{"u2", "👍", Reaction{Emoji: "👍", Count: 2, Reacted: true}},
+		{"u2", "🎉", Reaction{Emoji: "🎉", Count: 1, Reacted: true}},
+		{"u2", "🎉", Reaction{Emoji: "🎉", Count: 0}},
+		{"u2", "👍🏽", Reaction{Emoji: "👍🏽", Count: 1, Reacted: true}},
+	} {
+		got, err := svc.ToggleReaction(ctx, "r1", tc.user, msg.ID, tc.emoji)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("ToggleReaction(%s, %s) = %+v, want %+v", tc.user, tc.emoji, got, tc.want)
+		}
+	}
+
+	msgs, err := svc.ListFirst(ctx, "r1", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Reactions(msgs[0].Reactions)
+	want := []Reaction{{Emoji: "👍", Count: 2, Reacted: true}, {Emoji: "👍🏽", Count: 1}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("reactions = %+v, want %+v", got, want)
+	}
+}
@@ -4,6 +4,7 @@ package services
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"rplatform-echo/internal/repository"
 
@@ -54,3 +55,45 @@ func (s *RoomService) Update(ctx context.Context, id string, name string) error
 	}
 	return s.q.UpdateRoom(ctx, repository.UpdateRoomParams{ID: id, Name: name})
 }
+
+// Members returns up to limit members of a room, as recorded by Enter,
+// whose name or email starts with prefix.
+func (s *RoomService) Members(ctx context.Context, roomID string, prefix string, limit int) ([]repository.SearchRoomMembersRow, error) {
+	if roomID == "" {
+		return nil, errors.New("roomID is required")
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+	return s.q.SearchRoomMembers(ctx, repository.SearchRoomMembersParams{
+		RoomID: roomID,
+		Prefix: escaped + "%",
+		Limit:  int64(limit),
+	})
+}
+
+// Users returns the members of a room, as recorded by Enter, by email.
+func (s *RoomService) Users(ctx context.Context, roomID string) ([]repository.ListRoomUsersRow, error) {
+	if roomID == "" {
+		return nil, errors.New("roomID is required")
+	}
+	return s.q.ListRoomUsers(ctx, roomID)
+}
+
+// Enter records userID as a member of a room, reporting whether they
+// weren't one already.
+func (s *RoomService) Enter(ctx context.Context, roomID string, userID string) (bool, error) {
+	if roomID == "" || userID == "" {
+		return false, errors.New("roomID and userID are required")
+	}
+	n, err := s.q.AddRoomUser(ctx, repository.AddRoomUserParams{RoomID: roomID, UserID: userID})
+	return n > 0, err
+}
+
+// Leave is the counterpart of Enter, reporting whether userID was a member
+// of the room.
+func (s *RoomService) Leave(ctx context.Context, roomID string, userID string) (bool, error) {
+	if roomID == "" || userID == "" {
+		return false, errors.New("roomID and userID are required")
+	}
+	n, err := s.q.RemoveRoomUser(ctx, repository.RemoveRoomUserParams{RoomID: roomID, UserID: userID})
+	return n > 0, err
+}
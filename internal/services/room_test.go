@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"rplatform-echo/internal/repository"
+)
+
+func TestEnterLeave(t *testing.T) {
+	db := openDB(t)
+	svc := NewRoomService(repository.New(db))
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		enter bool
+		want  bool
+	}{
+		{true, true},
+		{true, false},
+		{false, true},
+		{false, false},
+		{true, true},
+	} {
+		change := svc.Leave
+		if tc.enter {
+			change = svc.Enter
+		}
+		if got, err := change(ctx, "r1", "u1"); err != nil || got != tc.want {
+			t.Errorf("enter = %v: changed = %v, %v, want %v", tc.enter, got, err, tc.want)
+		}
+	}
+}
+
+func TestMembers(t *testing.T) {
+	db := openDB(t)
+	svc := NewRoomService(repository.New(db))
+	msgs := NewMessageService(db, repository.New(db), nil)
+	ctx := context.Background()
+
+	seed(t, db, map[string]string{"u1": "ann@x", "u2": "anna@x", "u3": "bob@x"}, map[string]string{"r1": "one"})
+	for _, id := range []string{"u1", "u3"} {
+		if _, err := svc.Enter(ctx, "r1", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// writing to a room doesn't make a member
+	if _, err := msgs.Create(ctx, "r1", "u2", "", "hi"); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := svc.Members(ctx, "r1", "an", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].ID != "u1" {
+		t.Errorf("Members = %+v, want u1", members)
+	}
+}
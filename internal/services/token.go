@@ -0,0 +1,90 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	"rplatform-echo/internal/repository"
+)
+
+// revokedRefresh is how often the revoked tokens are read again, picking
+// up logouts on other instances.
+const revokedRefresh = 5 * time.Second
+
+// TokenService keeps track of session tokens revoked before they expire,
+// such as on logout. They are checked against a copy kept in memory, so a
+// request doesn't wait on, or fail with, the database.
+type TokenService struct {
+	q *repository.Queries
+
+	mu       sync.Mutex
+	revoked  map[string]time.Time // token hash to expiry
+	loadedAt time.Time
+}
+
+func NewTokenService(q *repository.Queries) *TokenService {
+	return &TokenService{q: q, revoked: make(map[string]time.Time)}
+}
+
+// Revoke rejects token from now on. It is remembered until expiresAt,
+// when the token stops working anyway.
+func (s *TokenService) Revoke(ctx context.Context, token string, expiresAt time.Time) error {
+	hash := tokenHash(token)
+	s.mu.Lock()
+	s.revoked[hash] = expiresAt
+	s.mu.Unlock()
+
+	if err := s.q.DeleteExpiredTokens(ctx, time.Now().UTC()); err != nil {
+		return err
+	}
+	return s.q.RevokeToken(ctx, repository.RevokeTokenParams{
+		TokenHash: hash,
+		ExpiresAt: expiresAt.UTC(),
+	})
+}
+
+// IsRevoked reports whether token was revoked. If the revoked tokens can't
+// be read again, the last ones read are used.
+func (s *TokenService) IsRevoked(ctx context.Context, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if now.Sub(s.loadedAt) >= revokedRefresh {
+		s.load(ctx, now)
+	}
+	expiresAt, ok := s.revoked[tokenHash(token)]
+	return ok && now.Before(expiresAt)
+}
+
+// load replaces the revoked tokens with those stored, keeping the ones
+// revoked here in case they weren't stored. s.mu must be held.
+func (s *TokenService) load(ctx context.Context, now time.Time) {
+	// wait for the next refresh before trying again, whether this works or not
+	s.loadedAt = now
+	stored, err := s.q.ListRevokedTokens(ctx, now.UTC())
+	if err != nil {
+		log.Println("Error loading revoked tokens", err)
+		return
+	}
+	revoked := make(map[string]time.Time, len(stored))
+	for hash, expiresAt := range s.revoked {
+		if now.Before(expiresAt) {
+			revoked[hash] = expiresAt
+		}
+	}
+	for _, t := range stored {
+		revoked[t.TokenHash] = t.ExpiresAt
+	}
+	s.revoked = revoked
+}
+
+// tokenHash is what is stored of a token, so the table holds nothing that
+// could be used to sign in.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"rplatform-echo/internal/repository"
+)
+
+func TestTokenService(t *testing.T) {
+	db := openDB(t)
+	q := repository.New(db)
+	svc := NewTokenService(q)
+	ctx := context.Background()
+
+	if svc.IsRevoked(ctx, "a") {
+		t.Fatal("IsRevoked before Revoke = true")
+	}
+	if err := svc.Revoke(ctx, "a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// revoking twice, as on a second logout, is harmless
+	if err := svc.Revoke(ctx, "a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if !svc.IsRevoked(ctx, "a") {
+		t.Fatal("IsRevoked after Revoke = false")
+	}
+
+	// expired tokens are purged by the next revocation
+	if err := svc.Revoke(ctx, "b", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Revoke(ctx, "c", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("select count(*) from revoked_tokens").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("%d revoked tokens stored, want 2", n)
+	}
+
+	// another instance learns of a logout on its next refresh, and keeps
+	// what it knows while the database is unreachable
+	other := NewTokenService(q)
+	if !other.IsRevoked(ctx, "c") || other.IsRevoked(ctx, "b") {
+		t.Error("IsRevoked on another instance doesn't match the stored tokens")
+	}
+	db.Close()
+	other.loadedAt = time.Time{}
+	if !other.IsRevoked(ctx, "c") {
+		t.Error("IsRevoked forgot a revoked token when the database is unreachable")
+	}
+}
@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// abuseState is what a user's violations of the frame size and rate
+// limits led to. It is shared by their connections and HTTP posts on this
+// instance, so neither reconnecting nor posting resets a mute.
+type abuseState struct {
+	mu             sync.Mutex
+	violations     int
+	violationsFrom time.Time
+	mutes          int
+	mutedUntil     time.Time
+	lastLimitError time.Time
+	lastUsed       time.Time
+
+	// postLimiter is the token bucket of the user's HTTP posts, which
+	// count as one connection.
+	postLimiter *rate.Limiter
+}
+
+// limiter returns the bucket of the user's HTTP posts to a room with cfg.
+func (a *abuseState) limiter(cfg RoomConfig) *rate.Limiter {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.postLimiter == nil {
+		a.postLimiter = newLimiter(cfg.ConnRate, cfg.ConnBurst)
+	}
+	return a.postLimiter
+}
+
+// abuse returns the abuse state of userID. That of users who sent nothing
+// for a while and aren't muted is forgotten.
+func (m *RoomManager) abuse(userID string) *abuseState {
+	m.abuseMu.Lock()
+	defer m.abuseMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(m.abuseSwept) > violationWindow {
+		for id, a := range m.abuseStates {
+			a.mu.Lock()
+			idle := now.Sub(a.lastUsed) > violationWindow && now.After(a.mutedUntil)
+			a.mu.Unlock()
+			if idle {
+				delete(m.abuseStates, id)
+			}
+		}
+		m.abuseSwept = now
+	}
+
+	a, ok := m.abuseStates[userID]
+	if !ok {
+		a = &abuseState{lastUsed: now}
+		m.abuseStates[userID] = a
+	}
+	return a
+}
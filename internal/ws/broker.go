@@ -0,0 +1,128 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+var brokerBufferSize = 256 // buffered frames per room subscription
+
+// Broker carries room frames between hubs, possibly across server
+// instances. Every Room publishes its broadcasts to the broker and fans out
+// whatever it receives from its subscription to local clients.
+//
+// Publish must not block on slow subscribers.
+type Broker interface {
+	// Publish sends a frame to every subscriber of roomID.
+	Publish(ctx context.Context, roomID string, frame []byte) error
+
+	// Subscribe returns the frames published to roomID. The channel is
+	// closed once ctx is done.
+	Subscribe(ctx context.Context, roomID string) (<-chan []byte, error)
+
+	// Close stops the broker.
+	Close() error
+}
+
+// MemoryBroker fans frames out to subscribers in this process only.
+//
+// Publish never blocks, since hubs publish from the loop that drains
+// their own subscription. A subscriber too far behind loses frames
+// instead, and gets a session.resync before the next one it receives so
+// its clients reload.
+type MemoryBroker struct {
+	mu   sync.RWMutex
+	subs map[string]map[chan []byte]*memorySub
+}
+
+type memorySub struct {
+	// dropped counts the frames lost since the last resync, messages
+	// the chat messages among them.
+	dropped  atomic.Int64
+	messages atomic.Int64
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subs: make(map[string]map[chan []byte]*memorySub),
+	}
+}
+
+func (b *MemoryBroker) Publish(ctx context.Context, roomID string, frame []byte) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch, sub := range b.subs[roomID] {
+		if sub.dropped.Load() > 0 && !sub.resync(ch, roomID) {
+			sub.drop(frame)
+			continue
+		}
+		select {
+		case ch <- frame:
+		default:
+			log.Println("Broker subscription full, dropping frame for room", roomID)
+			sub.drop(frame)
+		}
+	}
+	return nil
+}
+
+func (s *memorySub) drop(frame []byte) {
+	s.dropped.Add(1)
+	var env struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(frame, &env) == nil && env.Type == EventChatMessage {
+		s.messages.Add(1)
+	}
+}
+
+// resync tells the subscriber it lost frames, if it has room for that.
+func (s *memorySub) resync(ch chan []byte, roomID string) bool {
+	frame, err := newFrame(EventSessionResync, "", roomID, SessionResync{
+		Reason: "room fell behind",
+		Missed: int(s.messages.Load()),
+	})
+	if err != nil {
+		log.Println("Error encoding", err)
+		return false
+	}
+	select {
+	case ch <- frame:
+		s.dropped.Store(0)
+		s.messages.Store(0)
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *MemoryBroker) Subscribe(ctx context.Context, roomID string) (<-chan []byte, error) {
+	ch := make(chan []byte, brokerBufferSize)
+
+	b.mu.Lock()
+	if b.subs[roomID] == nil {
+		b.subs[roomID] = make(map[chan []byte]*memorySub)
+	}
+	b.subs[roomID][ch] = &memorySub{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[roomID], ch)
+		if len(b.subs[roomID]) == 0 {
+			delete(b.subs, roomID)
+		}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+func (b *MemoryBroker) Close() error {
+	return nil
+}
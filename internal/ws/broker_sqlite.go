@@ -0,0 +1,150 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"rplatform-echo/internal/repository"
+
+	"github.com/oklog/ulid/v2"
+)
+
+var (
+	sqliteBrokerPollInterval = 100 * time.Millisecond // how often other instances' events are read
+	sqliteBrokerRetention    = time.Minute            // how long events stay in room_events
+	sqliteBrokerBatchSize    = 500                    // events read per poll
+	sqliteBrokerQueueSize    = 1024                   // frames waiting to be written
+)
+
+var errBrokerQueueFull = errors.New("broker queue is full")
+
+// SQLiteBroker shares room frames between server instances that use the
+// same SQLite database. Frames are delivered to local subscribers right
+// away and written to room_events, which every instance polls for frames
+// published elsewhere.
+type SQLiteBroker struct {
+	q      *repository.Queries
+	origin string
+	local  *MemoryBroker
+	queue  chan repository.CreateRoomEventParams
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewSQLiteBroker(q *repository.Queries) (*SQLiteBroker, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cursor, err := q.GetLatestRoomEventID(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	b := &SQLiteBroker{
+		q:      q,
+		origin: ulid.Make().String(),
+		local:  NewMemoryBroker(),
+		queue:  make(chan repository.CreateRoomEventParams, sqliteBrokerQueueSize),
+		cancel: cancel,
+	}
+
+	b.wg.Add(2)
+	go b.write(ctx)
+	go b.poll(ctx, cursor)
+	return b, nil
+}
+
+func (b *SQLiteBroker) Publish(ctx context.Context, roomID string, frame []byte) error {
+	if err := b.local.Publish(ctx, roomID, frame); err != nil {
+		return err
+	}
+
+	select {
+	case b.queue <- repository.CreateRoomEventParams{RoomID: roomID, Origin: b.origin, Frame: frame}:
+		return nil
+	default:
+		return errBrokerQueueFull
+	}
+}
+
+func (b *SQLiteBroker) Subscribe(ctx context.Context, roomID string) (<-chan []byte, error) {
+	return b.local.Subscribe(ctx, roomID)
+}
+
+// Close stops polling and waits for queued frames to be written.
+func (b *SQLiteBroker) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return nil
+}
+
+func (b *SQLiteBroker) write(ctx context.Context) {
+	defer b.wg.Done()
+
+	for {
+		select {
+		case ev := <-b.queue:
+			if err := b.q.CreateRoomEvent(context.Background(), ev); err != nil {
+				log.Println("Error writing room event", err)
+			}
+		case <-ctx.Done():
+			for {
+				select {
+				case ev := <-b.queue:
+					if err := b.q.CreateRoomEvent(context.Background(), ev); err != nil {
+						log.Println("Error writing room event", err)
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *SQLiteBroker) poll(ctx context.Context, cursor int64) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(sqliteBrokerPollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+			events, err := b.q.GetRoomEventsAfter(ctx, repository.GetRoomEventsAfterParams{
+				ID:    cursor,
+				Limit: int64(sqliteBrokerBatchSize),
+			})
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("Error polling room events", err)
+				}
+				continue
+			}
+			for _, ev := range events {
+				cursor = ev.ID
+				if ev.Origin == b.origin {
+					// already delivered locally on publish
+					continue
+				}
+				if err := b.local.Publish(ctx, ev.RoomID, ev.Frame); err != nil {
+					log.Println("Error delivering room event", err)
+				}
+			}
+
+			if time.Since(lastCleanup) > sqliteBrokerRetention {
+				lastCleanup = time.Now()
+				if err := b.q.DeleteRoomEventsBefore(ctx, time.Now().Add(-sqliteBrokerRetention).UTC()); err != nil {
+					log.Println("Error deleting old room events", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
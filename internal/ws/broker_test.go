@@ -0,0 +1,125 @@
+package ws
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rplatform-echo/internal/repository"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+)
+
+func receive(t *testing.T, ch <-chan []byte) string {
+	t.Helper()
+	select {
+	case frame := <-ch:
+		return string(frame)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for frame")
+		return ""
+	}
+}
+
+func TestMemoryBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewMemoryBroker()
+
+	sub, _ := b.Subscribe(ctx, "room-a")
+	other, _ := b.Subscribe(ctx, "room-b")
+
+	if err := b.Publish(ctx, "room-a", []byte("hello")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if got := receive(t, sub); got != "hello" {
+		t.Errorf("Subscribe() got %q, want %q", got, "hello")
+	}
+	select {
+	case frame := <-other:
+		t.Errorf("other room got %q", frame)
+	default:
+	}
+
+	cancel()
+	if _, ok := <-sub; ok {
+		t.Error("subscription not closed after cancel")
+	}
+}
+
+func TestMemoryBrokerResyncsAfterDrops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewMemoryBroker()
+	sub, _ := b.Subscribe(ctx, "room-a")
+
+	for range brokerBufferSize {
+		b.Publish(ctx, "room-a", []byte(`{"type":"typing"}`))
+	}
+	b.Publish(ctx, "room-a", []byte(`{"type":"chat.message"}`))
+	for range brokerBufferSize {
+		receive(t, sub)
+	}
+
+	b.Publish(ctx, "room-a", []byte("next"))
+	if got := receive(t, sub); !strings.Contains(got, `"type":"session.resync"`) || !strings.Contains(got, `"missed":1`) {
+		t.Errorf("after a drop got %s, want a session.resync missing 1 message", got)
+	}
+	if got := receive(t, sub); got != "next" {
+		t.Errorf("after the resync got %q, want %q", got, "next")
+	}
+}
+
+func TestSQLiteBrokerAcrossInstances(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "broker.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	goose.SetLogger(goose.NopLogger())
+	if err := goose.SetDialect("sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(db, "../database/migrations"); err != nil {
+		t.Fatal(err)
+	}
+
+	sqliteBrokerPollInterval = 10 * time.Millisecond
+	q := repository.New(db)
+	a, err := NewSQLiteBroker(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewSQLiteBroker(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subA, _ := a.Subscribe(ctx, "room")
+	subB, _ := b.Subscribe(ctx, "room")
+
+	if err := a.Publish(ctx, "room", []byte("from a")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if got := receive(t, subA); got != "from a" {
+		t.Errorf("local subscriber got %q, want %q", got, "from a")
+	}
+	if got := receive(t, subB); got != "from a" {
+		t.Errorf("remote subscriber got %q, want %q", got, "from a")
+	}
+
+	// the publishing instance must not see its own frame twice
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case frame := <-subA:
+		t.Errorf("local subscriber got duplicate %q", frame)
+	default:
+	}
+}
@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+var (
+	cborEnc, _ = cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+	cborDec, _ = cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+)
+
+// jsonToCBOR re-encodes a JSON frame as CBOR. Whole numbers stay integers.
+func jsonToCBOR(raw []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return cborEnc.Marshal(fromJSON(v))
+}
+
+// fromJSON replaces the json.Numbers in v, which CBOR would encode as
+// strings, with int64 or float64.
+func fromJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = fromJSON(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = fromJSON(e)
+		}
+	}
+	return v
+}
+
+// cborToJSON re-encodes a CBOR frame as JSON, so it is decoded and
+// validated like any other.
+func cborToJSON(data []byte) ([]byte, error) {
+	var v any
+	if err := cborDec.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,56 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestCBORRoundTrip(t *testing.T) {
+	frame, err := newFrame(EventRoomClosed, "c1", "room", RoomClosed{Reason: "restart", Reconnect: true, RetryAfterMs: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := jsonToCBOR(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(frame) {
+		t.Errorf("CBOR frame is %d bytes, JSON %d", len(data), len(frame))
+	}
+
+	// whole numbers must stay integers for typed clients
+	var env struct {
+		Version int `cbor:"version"`
+		Payload struct {
+			RetryAfterMs int64 `cbor:"retry_after_ms"`
+		} `cbor:"payload"`
+	}
+	if err := cbor.Unmarshal(data, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != ProtocolVersion || env.Payload.RetryAfterMs != 1500 {
+		t.Errorf("decoded %+v", env)
+	}
+
+	back, err := cborToJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got any
+	json.Unmarshal(frame, &want)
+	json.Unmarshal(back, &got)
+	if a, b := mustJSON(want), mustJSON(got); a != b {
+		t.Errorf("round trip = %s, want %s", b, a)
+	}
+
+	if _, _, err := (&Client{subprotocol: SubprotocolCBOR}).decode([]byte{0xff}); err == nil {
+		t.Error("decoded invalid CBOR")
+	}
+}
+
+func mustJSON(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -4,145 +4,1351 @@ package ws
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
+	"io"
 	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"rplatform-echo/cmd/web"
+	"rplatform-echo/internal/repository"
+	"rplatform-echo/internal/services"
 
 	"github.com/coder/websocket"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
 )
 
 var (
-	writeTimeout         = 30 * time.Second // per-write timeout to client
-	subscriberBufferSize = 32               // buffered messages per client
+	writeTimeout     = 30 * time.Second // per-write timeout to client
+	maxReplay        = 100              // most missed messages replayed on resume
+	maxSubscriptions = 50               // rooms one multiplexed connection may follow
+	maxThreads       = 50               // threads one connection may follow
+	violationWindow  = time.Minute      // window MaxViolations are counted in
 )
 
+// errDropped is returned for a frame that is ignored without a reply.
+var errDropped = errors.New("frame dropped")
+
+// Subprotocols a client can negotiate through Sec-WebSocket-Protocol.
+// Clients that don't ask for one (such as the htmx ws extension) get htmx.
+// SubprotocolCBOR is the JSON protocol with every envelope encoded as CBOR
+// (RFC 8949) in binary frames, for clients on slow or metered links.
+const (
+	SubprotocolHTMX = "rplatform.htmx"
+	SubprotocolJSON = "rplatform.json.v1"
+	SubprotocolCBOR = "rplatform.cbor.v1"
+)
+
+// transport carries encoded frames to a client: a websocket or an SSE
+// stream.
+type transport interface {
+	// write sends data, the encoded form of f.
+	write(ctx context.Context, f *outbound, data []byte) error
+	// ping checks that the client is still there.
+	ping(ctx context.Context) error
+	// close ends the connection with status and reason, or drops it
+	// without a close handshake if status is 0.
+	close(status websocket.StatusCode, reason string)
+}
+
 type Client struct {
+	conn transport
+	send chan *outbound
+	// hub is the room a single-room connection is bound to, nil on a
+	// multiplexed connection.
+	hub     *Room
+	manager *RoomManager
+
+	userID      string
+	email       string
+	subprotocol string
+	// lastID is the last message the client saw before reconnecting.
+	lastID string
+	// token is the raw session token the client connected with, expires
+	// when it stops being valid.
+	token   string
+	expires time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// lastSeen is when anything (a frame or a pong) was last read, in unix nanoseconds.
+	lastSeen atomic.Int64
+
+	// subs are the rooms the client may send to, only touched by readPump.
+	subs map[string]*subscription
+	// joins hands subscribe and unsubscribe requests to writePump, which
+	// registers with the room and replays ahead of its live frames.
+	joins chan join
+	// unread counts messages per room for the room list, only touched by
+	// writePump.
+	unread map[string]int
+	// announced are the announcements sent to the client, only touched by
+	// writePump, which sends each once however many rooms it arrives in.
+	announced map[string]bool
+	// threads are the ids of the threads the client follows; writePump
+	// drops the replies of the others.
+	threadsMu sync.Mutex
+	threads   map[string]bool
+	// threadOnly is the thread of a stream opened by a thread panel next
+	// to the room's own, which only gets the thread's replies.
+	threadOnly string
+
+	// kicked is closed when the server gives up on the client; writePump
+	// then sends kickErr and closes the connection with kickStatus.
+	kicked     chan struct{}
+	kickOnce   sync.Once
+	kickStatus websocket.StatusCode
+	kickErr    *ProtocolError
+
+	// limiter is the connection's token bucket, cfg the limits it is held
+	// to outside of a room.
+	limiter *rate.Limiter
+	cfg     RoomConfig
+	// abuse is the user's violations and mutes, shared by all their
+	// connections.
+	abuse *abuseState
+
+	// behind is signalled once frames were dropped for the client being
+	// slow, so writePump tells it right away; missed counts the dropped
+	// messages per room.
+	behind   chan struct{}
+	missedMu sync.Mutex
+	missed   map[string]int
+
+	// detached clients are never registered with the hub; frames for them
+	// only are collected in replies instead.
+	detached bool
+	replies  [][]byte
+}
+
+// subscription is a room followed by a client.
+type subscription struct {
+	room *Room
+
+	// typing throttle state
+	lastTyping time.Time
+	typingSent bool
+}
+
+// join asks writePump to register with room, or to unregister on leave.
+type join struct {
+	room   *Room
+	lastID string
+	leave  bool
+}
+
+// newClient builds a client for the user authenticated on c. A client of
+// hub is bound to that room; with a nil hub it follows the rooms it
+// subscribes to.
+func newClient(ctx context.Context, manager *RoomManager, hub *Room, c echo.Context, conn transport, subprotocol string) *Client {
+	userID, email, token := identity(c)
+	ctx, cancel := context.WithCancel(ctx)
+	cfg := manager.cfg.Room
+	if hub != nil {
+		cfg = hub.cfg
+	}
+	client := &Client{
+		hub:         hub,
+		manager:     manager,
+		conn:        conn,
+		send:        make(chan *outbound, manager.cfg.SendBufferSize),
+		userID:      userID,
+		email:       email,
+		token:       token.Raw,
+		subprotocol: subprotocol,
+		ctx:         ctx,
+		cancel:      cancel,
+		subs:        make(map[string]*subscription),
+		announced:   make(map[string]bool),
+		threads:     make(map[string]bool),
+		joins:       make(chan join),
+		kicked:      make(chan struct{}),
+		behind:      make(chan struct{}, 1),
+		missed:      make(map[string]int),
+		limiter:     newLimiter(cfg.ConnRate, cfg.ConnBurst),
+		cfg:         cfg,
+		abuse:       manager.abuse(userID),
+	}
+	if hub != nil {
+		client.subs[hub.id] = &subscription{room: hub}
+	}
+	if exp, err := token.Claims.GetExpirationTime(); err == nil && exp != nil {
+		client.expires = exp.Time
+	}
+	client.lastSeen.Store(time.Now().UnixNano())
+	return client
+}
+
+// identity returns the user behind the JWT checked by the dashboard
+// middleware, and the token itself.
+func identity(c echo.Context) (userID string, email string, token *jwt.Token) {
+	token = c.Get("user").(*jwt.Token)
+	claims := token.Claims.(jwt.MapClaims)
+	return claims["user_id"].(string), claims["email"].(string), token
+}
+
+// wsConn is the websocket transport.
+type wsConn struct {
 	conn *websocket.Conn
-	send chan []byte
-	hub  *Room
+	// typ is the frame type, binary for SubprotocolCBOR.
+	typ websocket.MessageType
+}
+
+func newWSConn(conn *websocket.Conn, subprotocol string) *wsConn {
+	if subprotocol == SubprotocolCBOR {
+		return &wsConn{conn: conn, typ: websocket.MessageBinary}
+	}
+	return &wsConn{conn: conn, typ: websocket.MessageText}
+}
 
-	userID string
-	email  string
+func (t *wsConn) write(ctx context.Context, f *outbound, data []byte) error {
+	return writeWithTimeout(ctx, writeTimeout, t.conn, data, t.typ)
 }
 
-func (c *Client) readPump() {
-	ctx := context.Background()
-	defer func() {
-		c.hub.unregister <- c
-		if err := c.conn.CloseNow(); err != nil {
-			log.Println("Error closing connection")
+func (t *wsConn) ping(ctx context.Context) error {
+	return t.conn.Ping(ctx)
+}
+
+func (t *wsConn) close(status websocket.StatusCode, reason string) {
+	if status != 0 {
+		if err := t.conn.Close(status, reason); err != nil {
+			log.Println("Error closing connection", err)
 		}
+		return
+	}
+	if err := t.conn.CloseNow(); err != nil {
+		log.Println("Error closing connection")
+	}
+}
+
+func (c *Client) readPump(conn *websocket.Conn) {
+	ctx := c.ctx
+	defer func() {
+		c.cancel()
+		c.conn.close(0, "")
 	}()
 
+	// frames over a room's MaxFrameSize get an error frame, frames far
+	// over any of them end the connection
+	if n := c.manager.cfg.maxFrameSize(); n > 0 {
+		conn.SetReadLimit(2 * n)
+	} else {
+		conn.SetReadLimit(-1)
+	}
+
 	for {
-		_, msg, err := c.conn.Read(ctx)
+		_, msg, err := conn.Read(ctx)
 		if err != nil {
-			if websocket.CloseStatus(err) == websocket.StatusNormalClosure || websocket.CloseStatus(err) == websocket.StatusGoingAway {
+			switch websocket.CloseStatus(err) {
+			case websocket.StatusNormalClosure, websocket.StatusGoingAway, websocket.StatusServiceRestart:
 				// normal close
 				return
 			}
 			log.Printf("Error reading ws %v", err)
 			return
 		}
-		var msgMap map[string]any
-		if err := json.Unmarshal(msg, &msgMap); err != nil {
-			// send normal message if decode errors
-			c.hub.broadcast <- msg
-		} else {
-			msgMap["sender_id"] = c.userID
-			msgMap["email"] = c.email
-			_msgContent, ok := msgMap["chat_message"].(string)
-			var msgContent string
-			if ok {
-				msgContent = _msgContent
-			}
-			msgToSend, err := json.Marshal(msgMap)
-			if err != nil {
-				c.hub.broadcast <- msg
-			} else {
-				c.hub.broadcast <- msgToSend
+		c.lastSeen.Store(time.Now().UnixNano())
+
+		env, p, err := c.decode(msg)
+		if admitErr := c.admit(env, len(msg)); admitErr != nil {
+			err = admitErr
+		} else if err == nil {
+			err = c.handle(env, p)
+		}
+		if err != nil {
+			c.sendError(env, err)
+		}
+	}
+}
+
+// decode decodes a frame read in the client's negotiated format.
+func (c *Client) decode(msg []byte) (*Envelope, payload, error) {
+	if c.subprotocol == SubprotocolCBOR {
+		raw, err := cborToJSON(msg)
+		if err != nil {
+			return nil, nil, protocolErrorf(ErrCodeBadFrame, "frame is not a valid CBOR envelope")
+		}
+		msg = raw
+	}
+	return decodeFrame(msg)
+}
+
+// admit applies the frame size and rate limits of the room a frame is for,
+// or of the connection if it isn't for one. Repeated violations mute the
+// user for a while, and then disconnect the connection.
+func (c *Client) admit(env *Envelope, size int) error {
+	cfg, limited := c.cfg, !c.limiter.Allow()
+	if env != nil {
+		if s, err := c.subscription(env); err == nil {
+			cfg = s.room.cfg
+			limited = !s.room.allowUser(c.userID) || limited
+		}
+	}
+
+	var perr *ProtocolError
+	switch {
+	case cfg.MaxFrameSize > 0 && int64(size) > cfg.MaxFrameSize:
+		perr = protocolErrorf(ErrCodeFrameTooLarge, "frame exceeds %d bytes", cfg.MaxFrameSize)
+	case limited:
+		perr = protocolErrorf(ErrCodeRateLimited, "sending too fast, slow down")
+	}
+
+	a := c.abuse
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.lastUsed = now
+	if perr == nil {
+		if now.Before(a.mutedUntil) {
+			return protocolErrorf(ErrCodeMuted, "muted for another %s", a.mutedUntil.Sub(now).Round(time.Second))
+		}
+		return nil
+	}
+	metrics.Add(perr.Code, 1)
+
+	if now.Sub(a.violationsFrom) > violationWindow {
+		a.violations, a.violationsFrom = 0, now
+	}
+	a.violations++
+	if a.violations >= c.manager.cfg.MaxViolations {
+		a.violations = 0
+		a.mutes++
+		if a.mutes > c.manager.cfg.MaxMutes {
+			metrics.Add("evicted_abuse", 1)
+			c.kick(websocket.StatusPolicyViolation, protocolErrorf(ErrCodeAbuse, "disconnected for sending too much"))
+			return perr
+		}
+		metrics.Add("muted", 1)
+		a.mutedUntil = now.Add(c.manager.cfg.MuteDuration)
+		return protocolErrorf(ErrCodeMuted, "muted for %s for sending too much", c.manager.cfg.MuteDuration)
+	}
+
+	// one error frame per second is enough to tell a flooding client
+	if perr.Code == ErrCodeRateLimited {
+		if now.Sub(a.lastLimitError) < time.Second {
+			return errDropped
+		}
+		a.lastLimitError = now
+	}
+	return perr
+}
+
+// heartbeat pings the client every PingInterval and evicts the connection
+// once it misses MaxMissedPongs pongs in a row or nothing was read from it
+// for ReadTimeout. It also ends the session once the token it was opened
+// with expires, or is found revoked every AuthCheckInterval.
+func (c *Client) heartbeat() {
+	cfg := c.manager.cfg
+	ticker := time.NewTicker(cfg.PingInterval)
+	defer ticker.Stop()
+
+	var authCheck <-chan time.Time
+	if cfg.AuthCheckInterval > 0 && c.manager.tokenSvc != nil {
+		authTicker := time.NewTicker(cfg.AuthCheckInterval)
+		defer authTicker.Stop()
+		authCheck = authTicker.C
+	}
+	var expired <-chan time.Time
+	if !c.expires.IsZero() {
+		expiry := time.NewTimer(time.Until(c.expires))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	missed := 0
+	for {
+		select {
+		case <-expired:
+			c.endSession("expired", "session expired, sign in again")
+			return
+		case <-authCheck:
+			if c.manager.tokenSvc.IsRevoked(c.ctx, c.token) {
+				c.endSession("revoked", "signed out")
+				return
+			}
+		case <-ticker.C:
+			if idle := time.Since(time.Unix(0, c.lastSeen.Load())); idle > cfg.ReadTimeout {
+				log.Printf("Evicting client %s: nothing read for %s", c.email, idle.Round(time.Second))
+				c.evict("read_timeout")
+				return
 			}
-			// insert data to db here
-			if _, err := c.hub.manager.messageSvc.Create(ctx, c.hub.id, c.userID, msgContent); err != nil {
-				log.Println(err.Error())
+
+			ctx, cancel := context.WithTimeout(c.ctx, cfg.PongTimeout)
+			metrics.Add("pings_sent", 1)
+			err := c.conn.ping(ctx)
+			cancel()
+			if c.ctx.Err() != nil {
+				return
 			}
+			if err != nil {
+				missed++
+				metrics.Add("pongs_missed", 1)
+				log.Printf("Missed pong from client %s (%d/%d): %v", c.email, missed, cfg.MaxMissedPongs, err)
+				if missed >= cfg.MaxMissedPongs {
+					c.evict("missed_pongs")
+					return
+				}
+				continue
+			}
+			missed = 0
+			c.lastSeen.Store(time.Now().UnixNano())
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// evict drops a dead connection without a close handshake and stops the
+// pumps.
+func (c *Client) evict(reason string) {
+	metrics.Add("evicted_"+reason, 1)
+	c.conn.close(0, "")
+	c.cancel()
+}
+
+// endSession closes the connection of a user whose session is no longer
+// valid.
+func (c *Client) endSession(reason string, message string) {
+	metrics.Add("evicted_session_"+reason, 1)
+	log.Printf("Closing client %s: session %s", c.email, reason)
+	c.kick(websocket.StatusPolicyViolation, protocolErrorf(ErrCodeUnauthorized, "%s", message))
+}
+
+// handle dispatches a validated envelope to its registered handler.
+func (c *Client) handle(env *Envelope, p payload) error {
+	return events[env.Type].handle(c, env, p)
+}
+
+// subscription returns the room env is addressed to. A single-room client
+// defaults to its room; a multiplexed one has to name a subscribed room.
+func (c *Client) subscription(env *Envelope) (*subscription, error) {
+	roomID := env.Room
+	if roomID == "" && c.hub != nil {
+		roomID = c.hub.id
+	}
+	if roomID == "" {
+		return nil, protocolErrorf(ErrCodeInvalidPayload, "room is required")
+	}
+	s, ok := c.sub(roomID)
+	if !ok {
+		if c.hub != nil {
+			return nil, protocolErrorf(ErrCodeRoomMismatch, "connected to room %s, not %s", c.hub.id, roomID)
+		}
+		return nil, protocolErrorf(ErrCodeRoomMismatch, "not subscribed to room %s", roomID)
+	}
+	return s, nil
+}
+
+// sub returns the subscription to a room whose hub is still running.
+func (c *Client) sub(roomID string) (*subscription, bool) {
+	s, ok := c.subs[roomID]
+	if ok && s.room.stopped() && s.room != c.hub {
+		delete(c.subs, roomID)
+		return nil, false
+	}
+	return s, ok
+}
+
+// handleSubscribe follows another room on a multiplexed connection. Frames
+// of a room start with whatever is missed since LastID.
+func (c *Client) handleSubscribe(env *Envelope, p *SubscribePayload) error {
+	if c.hub != nil {
+		return protocolErrorf(ErrCodeUnsupported, "connected to room %s only", c.hub.id)
+	}
+	if env.Room == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "room is required")
+	}
+	s, ok := c.sub(env.Room)
+	if !ok {
+		if len(c.subs) >= maxSubscriptions {
+			return protocolErrorf(ErrCodeLimitExceeded, "at most %d rooms per connection", maxSubscriptions)
+		}
+		room, err := c.manager.Open(c.ctx, env.Room)
+		if errors.Is(err, sql.ErrNoRows) {
+			return protocolErrorf(ErrCodeRoomNotFound, "room %s does not exist", env.Room)
+		}
+		if errors.Is(err, ErrShuttingDown) {
+			return protocolErrorf(ErrCodeUnavailable, "server is restarting, subscribe again once reconnected")
+		}
+		if err != nil {
+			return err
+		}
+		s = &subscription{room: room}
+		c.subs[env.Room] = s
+	}
+	c.requestJoin(join{room: s.room, lastID: p.LastID})
+	return nil
+}
+
+// handleUnsubscribe stops following a room on a multiplexed connection.
+func (c *Client) handleUnsubscribe(env *Envelope) error {
+	if c.hub != nil {
+		return protocolErrorf(ErrCodeUnsupported, "connected to room %s only", c.hub.id)
+	}
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	if err := c.handleTyping(env, false); err != nil {
+		return err
+	}
+	delete(c.subs, s.room.id)
+	c.requestJoin(join{room: s.room, leave: true})
+	return nil
+}
+
+func (c *Client) requestJoin(j join) {
+	select {
+	case c.joins <- j:
+	case <-c.ctx.Done():
+		if !j.leave {
+			c.manager.Release(j.room)
+		}
+	}
+}
+
+// handleChatSend stores the message before fanning it out, then acks the
+// sender. A retried client id is acked again without a second broadcast,
+// so once stored the message is fanned out even if the client goes away.
+func (c *Client) handleChatSend(env *Envelope, p *ChatSendPayload) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	if !c.manager.beginSend() {
+		return protocolErrorf(ErrCodeUnavailable, "server is restarting, send again once reconnected")
+	}
+	defer c.manager.endSend()
+
+	ctx := context.WithoutCancel(c.ctx)
+	room := s.room
+	var msg repository.Message
+	if p.ParentID != "" {
+		msg, err = c.manager.messageSvc.CreateReply(ctx, room.id, c.userID, env.ClientID, p.ParentID, p.Content, p.AlsoInRoom)
+	} else {
+		msg, err = c.manager.messageSvc.Create(ctx, room.id, c.userID, env.ClientID, p.Content)
+	}
+	switch {
+	case errors.Is(err, services.ErrInvalidParent):
+		return protocolErrorf(ErrCodeInvalidPayload, "%s", err)
+	case errors.Is(err, services.ErrDuplicateMessage):
+		return c.reply(room.id, EventChatAck, env.ClientID, ChatAck{ID: msg.ID, CreatedAt: msg.CreatedAt.Time})
+	case errors.Is(err, services.ErrQueueFull):
+		metrics.Add("persist_queue_full", 1)
+		return protocolErrorf(ErrCodeUnavailable, "server busy, send again shortly")
+	case errors.Is(err, services.ErrWriterClosed):
+		return protocolErrorf(ErrCodeUnavailable, "server is restarting, send again once reconnected")
+	case err != nil:
+		return err
+	}
+
+	if msg.ParentID.Valid {
+		err = c.broadcastReply(ctx, room, env, msg)
+	} else {
+		err = c.broadcast(room, EventChatMessage, env, newChatMessage(msg, c.email))
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.notifyMentions(ctx, msg, nil); err != nil {
+		log.Println("Error notifying mentions of message", msg.ID, err)
+	}
+	if err := c.handleTyping(env, false); err != nil {
+		return err
+	}
+	return c.reply(room.id, EventChatAck, env.ClientID, ChatAck{ID: msg.ID, CreatedAt: msg.CreatedAt.Time})
+}
+
+func (c *Client) broadcast(room *Room, typ string, env *Envelope, v any) error {
+	frame, err := newFrame(typ, env.ClientID, room.id, v)
+	if err != nil {
+		return err
+	}
+	offer(room, room.broadcast, frame)
+	return nil
+}
+
+// broadcastReply sends a reply to the subscribers of its thread, and to
+// the whole room if it was also sent there, then the thread's new reply
+// count to the room.
+func (c *Client) broadcastReply(ctx context.Context, room *Room, env *Envelope, msg repository.Message) error {
+	reply := newChatMessage(msg, c.email)
+	if err := c.broadcast(room, EventThreadReply, env, reply); err != nil {
+		return err
+	}
+	if msg.AlsoInRoom {
+		if err := c.broadcast(room, EventChatMessage, env, reply); err != nil {
+			return err
+		}
+	}
+	parent, err := c.manager.messageSvc.Get(ctx, room.id, msg.ParentID.String)
+	if err != nil {
+		return err
+	}
+	return c.broadcast(room, EventThreadUpdated, env, ThreadSummary{
+		ID:          parent.ID,
+		RoomID:      parent.RoomID,
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt.Time,
+	})
+}
+
+// notifyMentions tells the users a message mentions about it, except
+// those in notified, who were told already.
+func (c *Client) notifyMentions(ctx context.Context, msg repository.Message, notified []string) error {
+	mentioned, err := c.manager.messageSvc.Mentioned(ctx, msg.ID)
+	if err != nil {
+		return err
+	}
+	var userIDs []string
+	for _, userID := range mentioned {
+		if !slices.Contains(notified, userID) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return nil
+	}
+	room, err := c.manager.roomSvc.Get(ctx, msg.RoomID)
+	if err != nil {
+		return err
+	}
+	return c.manager.Notify(ctx, Mention{
+		MessageID: msg.ID,
+		RoomID:    msg.RoomID,
+		RoomName:  room.Name,
+		ParentID:  msg.ParentID.String,
+		SenderID:  msg.UserID,
+		Email:     c.email,
+		Content:   msg.Content,
+		CreatedAt: msg.CreatedAt.Time,
+		UserIDs:   userIDs,
+	})
+}
+
+// handleThreadSubscribe follows the replies in a thread of a room the
+// client is in.
+func (c *Client) handleThreadSubscribe(env *Envelope, p *ThreadPayload) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	msg, err := c.manager.messageSvc.Get(c.ctx, s.room.id, p.MessageID)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		return protocolErrorf(ErrCodeNotFound, "message %s not found", p.MessageID)
+	}
+	if err != nil {
+		return err
+	}
+	if msg.ParentID.Valid {
+		return protocolErrorf(ErrCodeInvalidPayload, "message %s is a reply, follow thread %s instead", msg.ID, msg.ParentID.String)
+	}
+
+	c.threadsMu.Lock()
+	if !c.threads[msg.ID] && len(c.threads) >= maxThreads {
+		c.threadsMu.Unlock()
+		return protocolErrorf(ErrCodeLimitExceeded, "at most %d threads per connection", maxThreads)
+	}
+	c.threads[msg.ID] = true
+	c.threadsMu.Unlock()
+	return c.reply(s.room.id, EventThreadSubscribed, env.ClientID, ThreadPayload{MessageID: msg.ID})
+}
+
+func (c *Client) handleThreadUnsubscribe(env *Envelope, p *ThreadPayload) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	c.threadsMu.Lock()
+	delete(c.threads, p.MessageID)
+	c.threadsMu.Unlock()
+	return c.reply(s.room.id, EventThreadUnsubscribed, env.ClientID, ThreadPayload{MessageID: p.MessageID})
+}
+
+// follows reports whether the client subscribed to thread.
+func (c *Client) follows(thread string) bool {
+	c.threadsMu.Lock()
+	defer c.threadsMu.Unlock()
+	return c.threads[thread]
+}
+
+// handleChatEdit replaces the content of one of the user's messages and
+// broadcasts the new version to the room.
+func (c *Client) handleChatEdit(env *Envelope, p *ChatEditPayload) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	if !c.manager.beginSend() {
+		return protocolErrorf(ErrCodeUnavailable, "server is restarting, send again once reconnected")
+	}
+	defer c.manager.endSend()
+
+	room := s.room
+	// only the users the edit mentions anew are notified
+	notified, err := c.manager.messageSvc.Mentioned(c.ctx, p.MessageID)
+	if err != nil {
+		return err
+	}
+	msg, err := c.manager.messageSvc.Edit(c.ctx, room.id, c.userID, p.MessageID, p.Content)
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		return protocolErrorf(ErrCodeNotFound, "message %s not found", p.MessageID)
+	case errors.Is(err, services.ErrNotAuthor):
+		return protocolErrorf(ErrCodeForbidden, "only the author can edit a message")
+	case err != nil:
+		return err
+	}
+
+	frame, err := newFrame(EventChatEdited, env.ClientID, room.id, newChatMessage(msg, c.email))
+	if err != nil {
+		return err
+	}
+	offer(room, room.broadcast, frame)
+	if err := c.notifyMentions(c.ctx, msg, notified); err != nil {
+		log.Println("Error notifying mentions of message", msg.ID, err)
+	}
+	return c.reply(room.id, EventChatAck, env.ClientID, ChatAck{ID: msg.ID, CreatedAt: msg.CreatedAt.Time})
+}
+
+// handleChatDelete replaces one of the user's messages, or any message for
+// moderators, with a tombstone and tells the room.
+func (c *Client) handleChatDelete(env *Envelope, p *ChatDeletePayload) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	if !c.manager.beginSend() {
+		return protocolErrorf(ErrCodeUnavailable, "server is restarting, send again once reconnected")
+	}
+	defer c.manager.endSend()
+
+	room := s.room
+	msg, err := c.manager.messageSvc.Delete(c.ctx, room.id, c.userID, p.MessageID, c.manager.isModerator(c.email))
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		return protocolErrorf(ErrCodeNotFound, "message %s not found", p.MessageID)
+	case errors.Is(err, services.ErrNotAuthor):
+		return protocolErrorf(ErrCodeForbidden, "only the author or a moderator can delete a message")
+	case err != nil:
+		return err
+	}
+
+	frame, err := newFrame(EventChatDeleted, env.ClientID, room.id, MessageDeleted{
+		ID:        msg.ID,
+		RoomID:    msg.RoomID,
+		DeletedBy: msg.DeletedBy.String,
+		DeletedAt: msg.DeletedAt.Time,
+	})
+	if err != nil {
+		return err
+	}
+	offer(room, room.broadcast, frame)
+	return c.reply(room.id, EventChatAck, env.ClientID, ChatAck{ID: msg.ID, CreatedAt: msg.CreatedAt.Time})
+}
+
+// handleReactionToggle adds or removes one of the user's reactions to a
+// message and tells the room the emoji's new count.
+func (c *Client) handleReactionToggle(env *Envelope, p *ReactionPayload) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	room := s.room
+	if !c.manager.beginSend() {
+		return protocolErrorf(ErrCodeUnavailable, "server is restarting, send again once reconnected")
+	}
+	defer c.manager.endSend()
+
+	r, err := c.manager.messageSvc.ToggleReaction(c.ctx, room.id, c.userID, p.MessageID, p.Emoji)
+	switch {
+	case errors.Is(err, services.ErrMessageNotFound):
+		return protocolErrorf(ErrCodeNotFound, "message %s not found", p.MessageID)
+	case errors.Is(err, services.ErrInvalidReaction):
+		return protocolErrorf(ErrCodeInvalidPayload, "%s", err)
+	case err != nil:
+		return err
+	}
+
+	if err := c.broadcast(room, EventReactionUpdated, env, ReactionUpdated{
+		MessageID: p.MessageID,
+		RoomID:    room.id,
+		UserID:    c.userID,
+		Emoji:     r.Emoji,
+		Count:     r.Count,
+		Added:     r.Reacted,
+	}); err != nil {
+		return err
+	}
+	return c.reply(room.id, EventChatAck, env.ClientID, ChatAck{ID: p.MessageID})
+}
+
+// newChatMessage is the payload for a stored message sent by email.
+func newChatMessage(msg repository.Message, email string) ChatMessage {
+	m := ChatMessage{
+		ID:        msg.ID,
+		RoomID:    msg.RoomID,
+		SenderID:  msg.UserID,
+		Email:     email,
+		Content:   msg.Content,
+		CreatedAt: msg.CreatedAt.Time,
+		Kind:      msg.Kind,
+	}
+	if msg.EditedAt.Valid {
+		m.EditedAt = &msg.EditedAt.Time
+	}
+	if msg.DeletedAt.Valid {
+		m.DeletedAt = &msg.DeletedAt.Time
+	}
+	m.ParentID = msg.ParentID.String
+	m.ReplyCount = msg.ReplyCount
+	if msg.LastReplyAt.Valid {
+		m.LastReplyAt = &msg.LastReplyAt.Time
+	}
+	return m
+}
+
+// handleTyping forwards typing state to the room. A client gets at most one
+// typing.start per typingThrottle, and a typing.stop only after a start.
+func (c *Client) handleTyping(env *Envelope, typing bool) error {
+	s, err := c.subscription(env)
+	if err != nil {
+		return err
+	}
+	if typing {
+		now := time.Now()
+		if now.Sub(s.lastTyping) < typingThrottle {
+			metrics.Add("typing_throttled", 1)
+			return nil
+		}
+		s.lastTyping = now
+	} else if !s.typingSent && !c.detached {
+		return nil
+	}
+	s.typingSent = typing
+	offer(s.room, s.room.typing, typingUpdate{client: c, typing: typing})
+	return nil
+}
+
+// sendError replies to this client only with a frame describing err: a
+// nack for a failed chat.send, an error frame for anything else.
+func (c *Client) sendError(env *Envelope, err error) {
+	if err == errDropped {
+		return
+	}
+	perr, ok := err.(*ProtocolError)
+	if !ok {
+		log.Printf("Error handling ws frame %v", err)
+		perr = protocolErrorf(ErrCodeInternal, "internal error")
+	}
+	typ, clientID, room := EventError, "", ""
+	if c.hub != nil {
+		room = c.hub.id
+	}
+	if env != nil {
+		clientID = env.ClientID
+		if env.Room != "" {
+			room = env.Room
+		}
+		if env.Type == EventChatSend {
+			typ = EventChatNack
 		}
 	}
+	if err := c.reply(room, typ, clientID, perr); err != nil {
+		log.Println("Error encoding", err)
+	}
+}
+
+// reply sends a frame to this client only.
+func (c *Client) reply(room string, typ string, clientID string, v any) error {
+	frame, err := newFrame(typ, clientID, room, v)
+	if err != nil {
+		return err
+	}
+	if c.detached {
+		c.replies = append(c.replies, frame)
+		return nil
+	}
+	select {
+	case c.send <- newOutbound(frame):
+	default:
+		c.kick(websocket.StatusTryAgainLater, protocolErrorf(ErrCodeSlowConsumer, "too slow to keep up with replies"))
+	}
+	return nil
 }
 
+// kick has writePump close the connection with status, telling the client
+// why with an error frame. It is safe to call from any goroutine.
+func (c *Client) kick(status websocket.StatusCode, perr *ProtocolError) {
+	c.kickOnce.Do(func() {
+		c.kickStatus = status
+		c.kickErr = perr
+		close(c.kicked)
+	})
+}
+
+// fellBehind records a frame of room dropped for the client being slow.
+func (c *Client) fellBehind(roomID string, message bool) {
+	c.missedMu.Lock()
+	if message {
+		c.missed[roomID]++
+	} else if _, ok := c.missed[roomID]; !ok {
+		c.missed[roomID] = 0
+	}
+	c.missedMu.Unlock()
+	select {
+	case c.behind <- struct{}{}:
+	default:
+	}
+}
+
+// writeMissed tells the client which rooms it has to reload after frames
+// were dropped.
+func (c *Client) writeMissed(ctx context.Context, buf *bytes.Buffer) {
+	c.missedMu.Lock()
+	missed := c.missed
+	c.missed = make(map[string]int)
+	c.missedMu.Unlock()
+
+	for roomID, n := range missed {
+		resync := SessionResync{Reason: "connection fell behind", Missed: n}
+		frame, err := newFrame(EventSessionResync, "", roomID, resync)
+		if err == nil {
+			err = c.write(ctx, buf, newOutbound(frame))
+		}
+		if err != nil {
+			log.Printf("Error writing ws %v", err)
+		}
+	}
+}
+
+// writePump owns the client's room registrations: it registers with each
+// joined room, replays what was missed, and writes frames until the client
+// is done. The references to the rooms are released when it returns.
 func (c *Client) writePump() {
-	// ctx := context.Background()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	defer c.manager.pumps.Done()
+
+	// a thread panel's stream leaves notifications to the room's
+	if c.threadOnly == "" {
+		c.manager.addClient(c)
+		defer c.manager.removeClient(c)
+	}
+
+	ctx := c.ctx
+	rooms := make(map[string]*Room)
+
+	// a single-room client is closed by its hub on restart, a multiplexed
+	// one by the manager
+	var restart <-chan struct{}
+	if c.hub == nil {
+		restart = c.manager.ctx.Done()
+	}
+
+	// close status for the transport, if the client is closed on purpose
+	var status websocket.StatusCode
+	var reason string
 	defer func() {
-		if err := c.conn.CloseNow(); err != nil {
-			log.Println("Error closing connection")
+		c.conn.close(status, reason)
+		c.cancel()
+		for _, room := range rooms {
+			offer(room, room.unregister, c)
+			c.manager.Release(room)
 		}
-		c.hub.unregister <- c
 	}()
 
 	var buf bytes.Buffer
 
+	// replayed are the ids of the messages replayed in each room, whose
+	// live frames may still be on their way; ids are minted before the
+	// messages are committed, so they need not be the last ones
+	replayed := make(map[string]map[string]bool)
+	if c.hub != nil {
+		rooms[c.hub.id] = c.hub
+		if !offer(c.hub, c.hub.register, c) {
+			status, reason = websocket.StatusGoingAway, "room closed"
+			return
+		}
+		replayed[c.hub.id] = c.replay(ctx, &buf, c.hub.id, c.lastID)
+		if c.threadOnly == "" {
+			c.writeAnnouncements(ctx, &buf, c.hub.id)
+		}
+	}
+
 	for {
 		select {
-		case msg, ok := <-c.send:
-			if !ok {
-				return
+		case j := <-c.joins:
+			id := j.room.id
+			if j.leave {
+				if room, ok := rooms[id]; ok {
+					offer(room, room.unregister, c)
+					c.manager.Release(room)
+					delete(rooms, id)
+					delete(replayed, id)
+				}
+				c.writeSubscription(ctx, &buf, EventRoomUnsubscribed, id, rooms)
+				continue
 			}
-			buf.Reset()
-
-			var msgToSend map[string]any
-			if err := json.Unmarshal(msg, &msgToSend); err != nil {
-				log.Println("Error decoding", err)
+			if _, ok := rooms[id]; !ok {
+				if !offer(j.room, j.room.register, c) {
+					c.manager.Release(j.room)
+					c.writeRoomClosed(ctx, &buf, id, "room closed")
+					continue
+				}
+				rooms[id] = j.room
+			}
+			c.writeSubscription(ctx, &buf, EventRoomSubscribed, id, rooms)
+			replayed[id] = c.replay(ctx, &buf, id, j.lastID)
+			c.writeAnnouncements(ctx, &buf, id)
+		case msg := <-c.send:
+			room := msg.env.Room
+			if msg.env.Type == EventRoomClosed {
+				// the room's hub stopped and forgot this client
+				if err := c.write(ctx, &buf, msg); err != nil {
+					log.Printf("Error writing ws %v", err)
+				}
+				if c.hub != nil {
+					status, reason = msg.closeStatus()
+					return
+				}
+				if r, ok := rooms[room]; ok {
+					c.manager.Release(r)
+					delete(rooms, room)
+					delete(replayed, room)
+				}
+				continue
+			}
+			if c.threadOnly != "" && msg.thread != c.threadOnly {
+				continue
+			}
+			if a, ok := msg.payload.(*Announcement); ok {
+				if c.announced[a.ID] {
+					continue
+				}
+				c.announced[a.ID] = true
+			}
+			if msg.thread != "" && !c.follows(msg.thread) {
+				continue
+			}
+			if ids := replayed[room]; ids[msg.id] {
+				// skip live messages the replay already delivered
+				delete(ids, msg.id)
+				if len(ids) == 0 {
+					delete(replayed, room)
+				}
+				continue
+			}
+			if err := c.write(ctx, &buf, msg); err != nil {
+				log.Printf("Error writing ws %v", err)
+			}
+		case <-c.behind:
+			c.writeMissed(ctx, &buf)
+		case <-c.kicked:
+			frame, err := newFrame(EventError, "", "", c.kickErr)
+			if err == nil {
+				err = c.write(ctx, &buf, newOutbound(frame))
 			}
-			err := web.ChatMessage(msgToSend["email"].(string), msgToSend["chat_message"].(string), c.userID, msgToSend["sender_id"].(string)).Render(context.Background(), &buf)
 			if err != nil {
-				log.Println("Error encoding", err)
+				log.Printf("Error writing ws %v", err)
+			}
+			log.Printf("Disconnecting client %s: %s", c.email, c.kickErr.Message)
+			status, reason = c.kickStatus, c.kickErr.Message
+			return
+		case <-restart:
+			closed := RoomClosed{Reason: ErrShuttingDown.Error(), Reconnect: true}
+			if jitter := c.manager.cfg.ReconnectJitter.Milliseconds(); jitter > 0 {
+				closed.RetryAfterMs = rand.Int64N(jitter)
 			}
-			html := buf.Bytes()
-			if err := writeWithTimeout(ctx, writeTimeout, c.conn, html, websocket.MessageText); err != nil {
+			frame, err := newFrame(EventRoomClosed, "", "", closed)
+			if err == nil {
+				err = c.write(ctx, &buf, newOutbound(frame))
+			}
+			if err != nil {
 				log.Printf("Error writing ws %v", err)
 			}
+			status, reason = websocket.StatusServiceRestart, closed.Reason
+			return
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// writeAnnouncements sends the active announcements of a room the client
+// just joined that it didn't get yet.
+func (c *Client) writeAnnouncements(ctx context.Context, buf *bytes.Buffer, roomID string) {
+	if c.manager.announcementSvc == nil {
+		return
+	}
+	active, err := c.manager.announcementSvc.Active(ctx, roomID)
+	if err != nil {
+		log.Println("Error loading announcements", err)
+		return
+	}
+	for _, a := range active {
+		if c.announced[a.ID] {
+			continue
+		}
+		c.announced[a.ID] = true
+		frame, err := newFrame(EventAnnouncement, "", roomID, Announcement{
+			ID:        a.ID,
+			Severity:  a.Severity,
+			Content:   a.Content,
+			CreatedAt: a.CreatedAt.Time,
+			ExpiresAt: a.ExpiresAt,
+			Scoped:    a.Scoped != 0,
+		})
+		if err == nil {
+			err = c.write(ctx, buf, newOutbound(frame))
+		}
+		if err != nil {
+			log.Printf("Error writing ws %v", err)
+			return
+		}
+	}
+}
+
+// writeSubscription confirms a subscribe or unsubscribe with the rooms the
+// client now follows.
+func (c *Client) writeSubscription(ctx context.Context, buf *bytes.Buffer, typ string, roomID string, rooms map[string]*Room) {
+	sub := Subscription{Rooms: make([]string, 0, len(rooms))}
+	for id := range rooms {
+		sub.Rooms = append(sub.Rooms, id)
+	}
+	sort.Strings(sub.Rooms)
+	frame, err := newFrame(typ, "", roomID, sub)
+	if err == nil {
+		err = c.write(ctx, buf, newOutbound(frame))
+	}
+	if err != nil {
+		log.Printf("Error writing ws %v", err)
+	}
+}
+
+// writeRoomClosed tells the client a room it asked for has stopped.
+func (c *Client) writeRoomClosed(ctx context.Context, buf *bytes.Buffer, roomID string, reason string) {
+	frame, err := newFrame(EventRoomClosed, "", roomID, RoomClosed{Reason: reason})
+	if err == nil {
+		err = c.write(ctx, buf, newOutbound(frame))
+	}
+	if err != nil {
+		log.Printf("Error writing ws %v", err)
+	}
+}
+
+// replay sends the messages of room missed since lastID ahead of live
+// traffic and returns the ids of those sent. If the gap is larger than
+// maxReplay the client is told to resync instead.
+func (c *Client) replay(ctx context.Context, buf *bytes.Buffer, roomID string, lastID string) map[string]bool {
+	if lastID == "" {
+		return nil
+	}
+
+	msgs, err := c.manager.messageSvc.ListAfter(ctx, roomID, lastID, maxReplay+1)
+	if err != nil || len(msgs) > maxReplay {
+		reason := "too many missed messages"
+		if err != nil {
+			log.Println("Error replaying messages", err)
+			reason = "missed messages unavailable"
+		}
+		frame, err := newFrame(EventSessionResync, "", roomID, SessionResync{LastID: lastID, Reason: reason})
+		if err == nil {
+			err = c.write(ctx, buf, newOutbound(frame))
+		}
+		if err != nil {
+			log.Printf("Error writing ws %v", err)
+		}
+		return nil
+	}
+
+	sent := make(map[string]bool, len(msgs))
+	for _, m := range msgs {
+		msg := ChatMessage{
+			ID:        m.MessageID,
+			RoomID:    m.RoomID,
+			SenderID:  m.UserID,
+			Email:     m.UserEmail,
+			Content:   m.Content,
+			CreatedAt: m.CreatedAt.Time,
+			Kind:      m.Kind,
+		}
+		if m.EditedAt.Valid {
+			msg.EditedAt = &m.EditedAt.Time
+		}
+		if m.DeletedAt.Valid {
+			msg.DeletedAt = &m.DeletedAt.Time
+		}
+		msg.ParentID = m.ParentID.String
+		msg.ReplyCount = m.ReplyCount
+		if m.LastReplyAt.Valid {
+			msg.LastReplyAt = &m.LastReplyAt.Time
+		}
+		frame, err := newFrame(EventChatMessage, "", roomID, msg)
+		if err == nil {
+			err = c.write(ctx, buf, newOutbound(frame))
+		}
+		if err != nil {
+			log.Printf("Error writing ws %v", err)
+			return sent
+		}
+		sent[m.MessageID] = true
+	}
+
+	frame, err := newFrame(EventSessionResumed, "", roomID, SessionResumed{LastID: lastID, Replayed: len(msgs)})
+	if err == nil {
+		err = c.write(ctx, buf, newOutbound(frame))
+	}
+	if err != nil {
+		log.Printf("Error writing ws %v", err)
+	}
+	return sent
+}
+
+// write encodes frame for this client and writes it to its transport.
+func (c *Client) write(ctx context.Context, buf *bytes.Buffer, f *outbound) error {
+	data, err := c.encode(ctx, buf, f)
+	if err != nil {
+		log.Println("Error encoding", err)
+		return nil
+	}
+	if len(data) == 0 {
+		// nothing to show this client
+		return nil
+	}
+	return c.conn.write(ctx, f, data)
+}
+
+// encode returns f in the client's negotiated format. Only renderings
+// that differ per client use buf; the rest are shared by every client and
+// must not be modified.
+func (c *Client) encode(ctx context.Context, buf *bytes.Buffer, f *outbound) ([]byte, error) {
+	switch c.subprotocol {
+	case SubprotocolJSON:
+		return f.raw, nil
+	case SubprotocolCBOR:
+		return f.binary()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	if c.hub == nil {
+		buf.Reset()
+		err := c.renderRoomList(ctx, buf, f)
+		return buf.Bytes(), err
+	}
+	if t, ok := f.payload.(*Typing); ok && t.UserID == c.userID {
+		return nil, nil
+	}
+	return f.rendered(f.variantFor(c.userID))
+}
+
+// renderRoomList renders the events of a multiplexed connection for the
+// room list: unread badges for messages from other members.
+func (c *Client) renderRoomList(ctx context.Context, w io.Writer, f *outbound) error {
+	switch f.env.Type {
+	case EventChatMessage:
+		if m := f.payload.(*ChatMessage); m.Kind == services.MessageKindSystem || m.SenderID == c.userID {
+			return nil
+		}
+		if c.unread == nil {
+			c.unread = make(map[string]int)
+		}
+		room := f.env.Room
+		c.unread[room]++
+		return web.RoomUnread(room, c.unread[room]).Render(ctx, w)
+	case EventMention:
+		m := f.payload.(*Mention)
+		return web.MentionNotice(m.MessageID, m.RoomName, m.Email, m.Content).Render(ctx, w)
+	case EventAnnouncement:
+		// the room list shows the announcements for everyone only
+		if a := f.payload.(*Announcement); !a.Scoped {
+			return web.AnnouncementBanner(a.ID, a.Severity, a.Content, a.ExpiresAt).Render(ctx, w)
+		}
+		return nil
+	case EventError, EventChatNack:
+		log.Printf("Error frame for room list of %s: %s", c.email, f.env.Payload)
+		return nil
+	default:
+		return nil
+	}
+}
+
 func writeWithTimeout(ctx context.Context, timeout time.Duration, conn *websocket.Conn, msg []byte, typ websocket.MessageType) error {
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	return conn.Write(ctx, typ, msg)
 }
 
+// accept upgrades the request and negotiates the subprotocol and
+// compression. Requests from a page on another host are refused unless it
+// is in AllowedOrigins.
+func accept(manager *RoomManager, c echo.Context) (*websocket.Conn, string, error) {
+	conn, err := websocket.Accept(c.Response().Writer, c.Request(), &websocket.AcceptOptions{
+		Subprotocols:         []string{SubprotocolJSON, SubprotocolCBOR, SubprotocolHTMX},
+		OriginPatterns:       manager.cfg.AllowedOrigins,
+		CompressionMode:      manager.cfg.Compression.mode(),
+		CompressionThreshold: manager.cfg.CompressionThreshold,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	subprotocol := conn.Subprotocol()
+	if subprotocol == "" {
+		subprotocol = SubprotocolHTMX
+	}
+	return conn, subprotocol, nil
+}
+
+// ServeWs serves a socket bound to hub. It takes over the reference from
+// RoomManager.Open.
 func ServeWs(hub *Room, c echo.Context) error {
-	w := c.Response().Writer
-	r := c.Request()
-	conn, err := websocket.Accept(w, r, nil)
+	if !hub.manager.track() {
+		hub.manager.Release(hub)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrShuttingDown.Error())
+	}
+	conn, subprotocol, err := accept(hub.manager, c)
 	if err != nil {
+		hub.manager.pumps.Done()
+		hub.manager.Release(hub)
 		return err
 	}
-	user := c.Get("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-	userID := claims["user_id"].(string)
-	email := claims["email"].(string)
 
-	client := &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, subscriberBufferSize),
-		userID: userID,
-		email:  email,
+	client := newClient(context.Background(), hub.manager, hub, c, newWSConn(conn, subprotocol), subprotocol)
+	client.lastID = c.QueryParam("last_id")
+	log.Println("Client is registering", client.email, subprotocol)
+
+	go client.writePump()
+	go client.readPump(conn)
+	go client.heartbeat()
+	return nil
+}
+
+// ServeMultiplexed serves one socket for many rooms. The client follows
+// rooms with room.subscribe and room.unsubscribe frames, and every event
+// it gets carries the room it belongs to.
+func ServeMultiplexed(manager *RoomManager, c echo.Context) error {
+	if !manager.track() {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrShuttingDown.Error())
+	}
+	conn, subprotocol, err := accept(manager, c)
+	if err != nil {
+		manager.pumps.Done()
+		return err
 	}
-	log.Println("Client is registering", email)
 
-	client.hub.register <- client
+	client := newClient(context.Background(), manager, nil, c, newWSConn(conn, subprotocol), subprotocol)
+	log.Println("Client is connecting", client.email, "multiplexed", subprotocol)
 
 	go client.writePump()
-	go client.readPump()
+	go client.readPump(conn)
+	go client.heartbeat()
 	return nil
 }
@@ -0,0 +1,78 @@
+package ws
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAdmit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxViolations = 3
+	cfg.MaxMutes = 1
+	cfg.Room = RoomConfig{MaxFrameSize: 10, UserRate: 1, UserBurst: 1}
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), cfg)
+	room := NewRoom("room", m)
+	c := &Client{
+		manager: m,
+		hub:     room,
+		subs:    map[string]*subscription{"room": {room: room}},
+		kicked:  make(chan struct{}),
+		limiter: newLimiter(0, 0),
+		cfg:     room.cfg,
+		abuse:   m.abuse("u1"),
+	}
+	env := &Envelope{Type: EventChatSend}
+
+	code := func(err error) string {
+		if perr, ok := err.(*ProtocolError); ok {
+			return perr.Code
+		}
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+	// the oversized frame still takes the user's one token
+	want := []struct {
+		size int
+		code string
+	}{
+		{11, ErrCodeFrameTooLarge},
+		{5, ErrCodeRateLimited},
+		{5, ErrCodeMuted},
+		{5, errDropped.Error()},
+		{5, errDropped.Error()},
+	}
+	for i, w := range want {
+		if err := c.admit(env, w.size); code(err) != w.code {
+			t.Errorf("admit() #%d error = %v, want %s", i, err, w.code)
+		}
+	}
+	select {
+	case <-c.kicked:
+		t.Fatal("client kicked before exceeding MaxMutes")
+	default:
+	}
+
+	// a post of the user is muted too, even without running into a limit
+	post := &Client{
+		manager:  m,
+		kicked:   make(chan struct{}),
+		limiter:  newLimiter(0, 0),
+		abuse:    m.abuse("u1"),
+		detached: true,
+	}
+	if err := post.admit(nil, 5); code(err) != ErrCodeMuted {
+		t.Errorf("admit() on another connection error = %v, want %s", err, ErrCodeMuted)
+	}
+
+	c.admit(env, 5)
+	select {
+	case <-c.kicked:
+		if c.kickErr.Code != ErrCodeAbuse {
+			t.Errorf("kick code = %s, want %s", c.kickErr.Code, ErrCodeAbuse)
+		}
+	default:
+		t.Error("client not kicked after exceeding MaxMutes")
+	}
+}
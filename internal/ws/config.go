@@ -0,0 +1,188 @@
+package ws
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// SlowConsumerPolicy is what a room does when a client's send buffer is
+// full.
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDisconnect closes the connection with a reason; the
+	// client catches up by resuming once it reconnects.
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+	// SlowConsumerDropOldest drops the oldest queued frame to make room,
+	// or disconnects if that frame is one the client must not lose.
+	SlowConsumerDropOldest SlowConsumerPolicy = "drop_oldest"
+	// SlowConsumerResync drops frames until the client catches up, then
+	// tells it how many messages it missed so it reloads.
+	SlowConsumerResync SlowConsumerPolicy = "resync"
+)
+
+func (p SlowConsumerPolicy) Valid() bool {
+	switch p {
+	case SlowConsumerDisconnect, SlowConsumerDropOldest, SlowConsumerResync:
+		return true
+	}
+	return false
+}
+
+// Compression is how chat sockets use permessage-deflate, if the client
+// offers it.
+type Compression string
+
+const (
+	// CompressionOff sends every frame uncompressed.
+	CompressionOff Compression = "off"
+	// CompressionContextTakeover keeps a compression window per connection
+	// across frames, which compresses repetitive traffic best at the cost
+	// of some memory per connection.
+	CompressionContextTakeover Compression = "context_takeover"
+	// CompressionNoContextTakeover compresses each frame on its own.
+	CompressionNoContextTakeover Compression = "no_context_takeover"
+)
+
+func (c Compression) Valid() bool {
+	switch c {
+	case CompressionOff, CompressionContextTakeover, CompressionNoContextTakeover:
+		return true
+	}
+	return false
+}
+
+func (c Compression) mode() websocket.CompressionMode {
+	switch c {
+	case CompressionContextTakeover:
+		return websocket.CompressionContextTakeover
+	case CompressionNoContextTakeover:
+		return websocket.CompressionNoContextTakeover
+	default:
+		return websocket.CompressionDisabled
+	}
+}
+
+// RoomConfig holds the tunables that can differ per room.
+type RoomConfig struct {
+	// SlowConsumer is the policy for clients that can't keep up.
+	SlowConsumer SlowConsumerPolicy `json:"slow_consumer"`
+
+	// MaxFrameSize is the largest frame in bytes a client may send. 0
+	// means no limit.
+	MaxFrameSize int64 `json:"max_frame_size"`
+	// ConnRate frames per second, bursting to ConnBurst, may be sent on
+	// one connection. 0 means no limit.
+	ConnRate  float64 `json:"conn_rate"`
+	ConnBurst int     `json:"conn_burst"`
+	// UserRate and UserBurst limit the frames of one user to the room
+	// across all of their connections. 0 means no limit.
+	UserRate  float64 `json:"user_rate"`
+	UserBurst int     `json:"user_burst"`
+}
+
+// Config holds the tunables of the chat socket hubs.
+type Config struct {
+	// PingInterval is how often each connection is pinged.
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for the pong to a ping.
+	PongTimeout time.Duration
+	// MaxMissedPongs is how many pongs in a row may be missed before the
+	// connection is evicted.
+	MaxMissedPongs int
+	// ReadTimeout evicts a connection nothing was read from (frames or
+	// pongs) for this long.
+	ReadTimeout time.Duration
+	// RoomIdleTimeout stops a room hub nobody used for this long.
+	RoomIdleTimeout time.Duration
+	// PresenceGrace is how long a user may be gone from a room before
+	// they are recorded leaving it, so reconnects and reloads don't count.
+	PresenceGrace time.Duration
+	// ReconnectJitter is the window clients are told to spread their
+	// reconnects over when the server restarts.
+	ReconnectJitter time.Duration
+	// SendBufferSize is how many frames are queued per connection before
+	// the slow consumer policy applies.
+	SendBufferSize int
+
+	// MaxViolations rate or size violations within a minute mute a user
+	// on all their connections for MuteDuration. A user muted more than
+	// MaxMutes times is disconnected as they go on.
+	MaxViolations int
+	MuteDuration  time.Duration
+	MaxMutes      int
+
+	// AllowedOrigins are the host patterns (path.Match syntax, such as
+	// "*.example.com") of the pages that may open a chat socket or stream
+	// besides the server's own host.
+	AllowedOrigins []string
+	// AuthCheckInterval is how often a connection checks that its session
+	// wasn't revoked. 0 disables the check; expiry is enforced anyway.
+	AuthCheckInterval time.Duration
+	// Moderators are the lowercased emails of the users who may delete
+	// anyone's messages, not only their own.
+	Moderators []string
+
+	// Compression is the permessage-deflate mode of chat sockets. Frames
+	// smaller than CompressionThreshold bytes are sent uncompressed; 0
+	// keeps the library default.
+	Compression          Compression
+	CompressionThreshold int
+
+	// Room is the configuration of every room not listed in Rooms.
+	Room RoomConfig
+	// Rooms overrides Room for some room ids.
+	Rooms map[string]RoomConfig
+}
+
+// ForRoom returns the configuration of a room.
+func (c Config) ForRoom(roomID string) RoomConfig {
+	if rc, ok := c.Rooms[roomID]; ok {
+		return rc
+	}
+	return c.Room
+}
+
+// maxFrameSize is the largest MaxFrameSize of any room, 0 if a room has no
+// limit.
+func (c Config) maxFrameSize() int64 {
+	n := c.Room.MaxFrameSize
+	for _, rc := range c.Rooms {
+		if rc.MaxFrameSize <= 0 {
+			return 0
+		}
+		n = max(n, rc.MaxFrameSize)
+	}
+	return max(n, 0)
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PingInterval:      30 * time.Second,
+		PongTimeout:       10 * time.Second,
+		MaxMissedPongs:    2,
+		ReadTimeout:       90 * time.Second,
+		RoomIdleTimeout:   5 * time.Minute,
+		PresenceGrace:     30 * time.Second,
+		ReconnectJitter:   5 * time.Second,
+		SendBufferSize:    32,
+		MaxViolations:     5,
+		MuteDuration:      30 * time.Second,
+		MaxMutes:          2,
+		AuthCheckInterval: time.Minute,
+		Compression:       CompressionOff,
+		Room: RoomConfig{
+			SlowConsumer: SlowConsumerDisconnect,
+			MaxFrameSize: 32 << 10,
+			ConnRate:     5,
+			ConnBurst:    10,
+			UserRate:     10,
+			UserBurst:    20,
+		},
+	}
+}
+
+// metrics are published under "ws" on /debug/vars.
+var metrics = expvar.NewMap("ws")
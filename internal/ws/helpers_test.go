@@ -0,0 +1,31 @@
+package ws
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pressly/goose/v3"
+)
+
+// openDB returns a migrated database, seeded with seedSQL.
+func openDB(t testing.TB, seedSQL string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "chat.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	goose.SetLogger(goose.NopLogger())
+	if err := goose.SetDialect("sqlite3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := goose.Up(db, "../database/migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(seedSQL); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
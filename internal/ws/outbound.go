@@ -0,0 +1,244 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"rplatform-echo/cmd/web"
+	"rplatform-echo/internal/services"
+
+	"github.com/coder/websocket"
+)
+
+// variant is a rendering of a frame shared by a group of clients.
+type variant int
+
+const (
+	variantOther variant = iota // everyone but the sender of a chat.message
+	variantOwn                  // the sender of a chat.message
+	numVariants
+)
+
+// outbound is a frame on its way to clients. It is decoded once when it is
+// queued, and each HTML variant is rendered at most once and shared by all
+// the clients it goes to, so a broadcast costs the same template work
+// however many clients are in the room. The JSON form is raw itself.
+type outbound struct {
+	raw []byte
+	env Envelope
+	// id is the message id of a chat.message, not set for other events
+	// about messages such as chat.edited.
+	id string
+	// thread is the thread of a thread.reply, which only its subscribers
+	// get.
+	thread string
+	// payload is the decoded payload for the event types that render.
+	payload any
+	err     error
+
+	once [numVariants]sync.Once
+	html [numVariants][]byte
+	errs [numVariants]error
+
+	cborOnce sync.Once
+	cbor     []byte
+	cborErr  error
+}
+
+func newOutbound(raw []byte) *outbound {
+	f := &outbound{raw: raw}
+	if f.err = json.Unmarshal(raw, &f.env); f.err != nil {
+		return f
+	}
+
+	switch f.env.Type {
+	case EventChatMessage, EventChatEdited, EventThreadReply:
+		f.payload = &ChatMessage{}
+	case EventThreadUpdated:
+		f.payload = &ThreadSummary{}
+	case EventReactionUpdated:
+		f.payload = &ReactionUpdated{}
+	case EventMention:
+		f.payload = &Mention{}
+	case EventError, EventChatNack:
+		f.payload = &ProtocolError{}
+	case EventTyping:
+		f.payload = &Typing{}
+	case EventPresenceJoin, EventPresenceLeave:
+		f.payload = &Member{}
+	case EventSessionResync:
+		f.payload = &SessionResync{}
+	case EventRoomClosed:
+		f.payload = &RoomClosed{}
+	case EventAnnouncement:
+		f.payload = &Announcement{}
+	case EventChatDeleted:
+		f.payload = &MessageDeleted{}
+	default:
+		return f
+	}
+	f.err = json.Unmarshal(f.env.Payload, f.payload)
+	if m, ok := f.payload.(*ChatMessage); ok {
+		switch f.env.Type {
+		case EventChatMessage:
+			f.id = m.ID
+		case EventThreadReply:
+			f.thread = m.ParentID
+		}
+	}
+	return f
+}
+
+// droppable reports whether a slow client may lose the frame, being told
+// to resync instead. Replies and frames ending a room never are.
+func (f *outbound) droppable() bool {
+	switch f.env.Type {
+	case EventChatAck, EventChatNack, EventError, EventRoomClosed, EventSessionResync:
+		return false
+	}
+	return true
+}
+
+// variantFor is the variant the user sees.
+func (f *outbound) variantFor(userID string) variant {
+	switch p := f.payload.(type) {
+	case *ChatMessage:
+		if p.SenderID == userID {
+			return variantOwn
+		}
+	case *ReactionUpdated:
+		if p.UserID == userID {
+			return variantOwn
+		}
+	}
+	return variantOther
+}
+
+// rendered returns the HTML fragment of variant v, rendering it on first
+// use. The result is shared and must not be modified.
+func (f *outbound) rendered(v variant) ([]byte, error) {
+	f.once[v].Do(func() {
+		var buf bytes.Buffer
+		// the rendering outlives the client that asked for it first
+		f.errs[v] = f.render(context.Background(), &buf, v)
+		f.html[v] = buf.Bytes()
+	})
+	return f.html[v], f.errs[v]
+}
+
+// binary returns the CBOR encoding of the frame, encoding it on first use.
+// The result is shared and must not be modified.
+func (f *outbound) binary() ([]byte, error) {
+	f.cborOnce.Do(func() {
+		f.cbor, f.cborErr = jsonToCBOR(f.raw)
+	})
+	return f.cbor, f.cborErr
+}
+
+// render turns the envelope into the HTML fragment htmx swaps in.
+func (f *outbound) render(ctx context.Context, w io.Writer, v variant) error {
+	if f.err != nil {
+		return f.err
+	}
+	switch f.env.Type {
+	case EventChatMessage:
+		m := f.payload.(*ChatMessage)
+		if m.Kind == services.MessageKindSystem {
+			return web.SystemMessage(m.ID, m.Content).Render(ctx, w)
+		}
+		return web.ChatMessage(m.props(v)).Render(ctx, w)
+	case EventThreadReply:
+		p := f.payload.(*ChatMessage).props(v)
+		p.InThread = true
+		return web.ThreadReply(p).Render(ctx, w)
+	case EventThreadUpdated:
+		t := f.payload.(*ThreadSummary)
+		return web.ThreadSummary(t.RoomID, t.ID, t.ReplyCount, t.LastReplyAt).Render(ctx, w)
+	case EventReactionUpdated:
+		r := f.payload.(*ReactionUpdated)
+		return web.ReactionUpdated(r.RoomID, r.MessageID, r.Emoji, r.Count, r.Added, v == variantOwn).Render(ctx, w)
+	case EventChatEdited:
+		m := f.payload.(*ChatMessage)
+		return web.ChatMessageEdited(m.RoomID, m.ID, m.Content, v == variantOwn, m.editedAt()).Render(ctx, w)
+	case EventChatDeleted:
+		d := f.payload.(*MessageDeleted)
+		return web.ChatMessageDeleted(d.ID, d.Purged).Render(ctx, w)
+	case EventError:
+		return web.ChatError(f.payload.(*ProtocolError).Message).Render(ctx, w)
+	case EventChatNack:
+		return web.ChatError("Message not sent: "+f.payload.(*ProtocolError).Message).Render(ctx, w)
+	case EventChatAck:
+		return nil
+	case EventTyping:
+		t := f.payload.(*Typing)
+		if t.Typing {
+			return web.TypingStarted(t.UserID, t.Email).Render(ctx, w)
+		}
+		return web.TypingStopped(t.UserID).Render(ctx, w)
+	case EventPresenceJoin:
+		m := f.payload.(*Member)
+		return web.MemberJoined(web.OnlineUser{UserID: m.UserID, Email: m.Email}).Render(ctx, w)
+	case EventPresenceLeave:
+		return web.MemberLeft(f.payload.(*Member).UserID).Render(ctx, w)
+	case EventSessionResync:
+		return web.ChatResync(f.payload.(*SessionResync).Missed).Render(ctx, w)
+	case EventRoomClosed:
+		return web.ChatError("Room closed: "+f.payload.(*RoomClosed).Reason).Render(ctx, w)
+	case EventMention:
+		m := f.payload.(*Mention)
+		return web.MentionNotice(m.MessageID, m.RoomName, m.Email, m.Content).Render(ctx, w)
+	case EventAnnouncement:
+		a := f.payload.(*Announcement)
+		return web.AnnouncementBanner(a.ID, a.Severity, a.Content, a.ExpiresAt).Render(ctx, w)
+	case EventSessionResumed, EventRoomSubscribed, EventRoomUnsubscribed, EventThreadSubscribed, EventThreadUnsubscribed:
+		return nil
+	default:
+		return fmt.Errorf("no renderer for event type %q", f.env.Type)
+	}
+}
+
+// props is how the message is rendered for variant v.
+func (m *ChatMessage) props(v variant) web.ChatMessageProps {
+	p := web.ChatMessageProps{
+		RoomID:     m.RoomID,
+		MessageID:  m.ID,
+		SenderID:   m.SenderID,
+		Email:      m.Email,
+		Content:    m.Content,
+		ShowEmail:  true,
+		EditedAt:   m.editedAt(),
+		Deleted:    m.DeletedAt != nil,
+		ParentID:   m.ParentID,
+		ReplyCount: m.ReplyCount,
+	}
+	// the template only compares the viewer with the sender
+	if v == variantOwn {
+		p.ViewerID = m.SenderID
+	}
+	if m.LastReplyAt != nil {
+		p.LastReplyAt = *m.LastReplyAt
+	}
+	return p
+}
+
+// roomClosed is the payload of a room.closed frame.
+func (f *outbound) roomClosed() RoomClosed {
+	if closed, ok := f.payload.(*RoomClosed); ok {
+		return *closed
+	}
+	return RoomClosed{}
+}
+
+// closeStatus is the close status for a socket whose room closed: a
+// restart asks the client to reconnect.
+func (f *outbound) closeStatus() (websocket.StatusCode, string) {
+	closed := f.roomClosed()
+	if closed.Reconnect {
+		return websocket.StatusServiceRestart, closed.Reason
+	}
+	return websocket.StatusGoingAway, closed.Reason
+}
@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestOutboundVariants(t *testing.T) {
+	raw, _ := newFrame(EventChatMessage, "", "room", ChatMessage{ID: "1", SenderID: "u1", Email: "a@x", Content: "hi"})
+	f := newOutbound(raw)
+	sender := &Client{hub: &Room{}, userID: "u1", subprotocol: SubprotocolHTMX}
+	other := &Client{hub: &Room{}, userID: "u2", subprotocol: SubprotocolHTMX}
+
+	var buf bytes.Buffer
+	own, _ := sender.encode(context.Background(), &buf, f)
+	theirs, _ := other.encode(context.Background(), &buf, f)
+	if !strings.Contains(string(own), "ml-auto") || strings.Contains(string(own), "a@x") {
+		t.Errorf("sender got %s", own)
+	}
+	if strings.Contains(string(theirs), "ml-auto") || !strings.Contains(string(theirs), "a@x") {
+		t.Errorf("other member got %s", theirs)
+	}
+	again, _ := other.encode(context.Background(), &buf, f)
+	if &again[0] != &theirs[0] {
+		t.Error("frame rendered again for the same variant")
+	}
+}
+
+// benchmarkFanOut encodes a chat message for n htmx clients, one of them
+// the sender. shared hands every client the same outbound frame, as the
+// hub does; otherwise each client decodes and renders its own.
+func benchmarkFanOut(b *testing.B, n int, shared bool) {
+	raw, _ := newFrame(EventChatMessage, "", "room", ChatMessage{ID: "1", SenderID: "u0", Email: "a@x", Content: "hello there"})
+	clients := make([]*Client, n)
+	for i := range clients {
+		clients[i] = &Client{hub: &Room{}, userID: fmt.Sprint("u", i), subprotocol: SubprotocolHTMX}
+	}
+	ctx := context.Background()
+	var buf bytes.Buffer
+
+	b.ReportAllocs()
+	for b.Loop() {
+		f := newOutbound(raw)
+		for _, c := range clients {
+			if !shared {
+				f = newOutbound(raw)
+			}
+			if _, err := c.encode(ctx, &buf, f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkFanOut(b *testing.B) {
+	for _, n := range []int{10, 100, 500} {
+		b.Run(fmt.Sprint("shared/", n), func(b *testing.B) { benchmarkFanOut(b, n, true) })
+		b.Run(fmt.Sprint("per_client/", n), func(b *testing.B) { benchmarkFanOut(b, n, false) })
+	}
+}
@@ -0,0 +1,510 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ProtocolVersion is the envelope version spoken by this server.
+const ProtocolVersion = 1
+
+// Maximum chat message length in runes.
+const maxContentLength = 4000
+
+// Maximum length of a client-generated id.
+const maxClientIDLength = 64
+
+// Inbound event types (client -> server).
+const (
+	EventChatSend    = "chat.send"
+	EventChatEdit    = "chat.edit"
+	EventChatDelete  = "chat.delete"
+	EventTypingStart = "typing.start"
+	EventTypingStop  = "typing.stop"
+	EventSubscribe   = "room.subscribe"
+	EventUnsubscribe = "room.unsubscribe"
+
+	EventThreadSubscribe   = "thread.subscribe"
+	EventThreadUnsubscribe = "thread.unsubscribe"
+
+	EventReactionToggle = "reaction.toggle"
+)
+
+// Outbound event types (server -> client).
+const (
+	EventChatMessage      = "chat.message"
+	EventChatEdited       = "chat.edited"
+	EventChatDeleted      = "chat.deleted"
+	EventChatAck          = "chat.ack"
+	EventChatNack         = "chat.nack"
+	EventSessionResumed   = "session.resumed"
+	EventSessionResync    = "session.resync"
+	EventTyping           = "typing"
+	EventPresenceJoin     = "presence.join"
+	EventPresenceLeave    = "presence.leave"
+	EventRoomSubscribed   = "room.subscribed"
+	EventRoomUnsubscribed = "room.unsubscribed"
+	EventRoomClosed       = "room.closed"
+	EventAnnouncement     = "announcement"
+	EventError            = "error"
+
+	EventThreadReply        = "thread.reply"
+	EventThreadUpdated      = "thread.updated"
+	EventThreadSubscribed   = "thread.subscribed"
+	EventThreadUnsubscribed = "thread.unsubscribed"
+
+	EventReactionUpdated = "reaction.updated"
+
+	EventMention = "mention"
+)
+
+// Error codes carried by error frames.
+const (
+	ErrCodeBadFrame           = "bad_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownType        = "unknown_type"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeRoomMismatch       = "room_mismatch"
+	ErrCodeRoomNotFound       = "room_not_found"
+	ErrCodeLimitExceeded      = "limit_exceeded"
+	ErrCodeUnavailable        = "unavailable"
+	ErrCodeSlowConsumer       = "slow_consumer"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeFrameTooLarge      = "frame_too_large"
+	ErrCodeMuted              = "muted"
+	ErrCodeAbuse              = "abuse"
+	ErrCodeUnauthorized       = "unauthorized"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeUnsupported        = "unsupported"
+	ErrCodeInternal           = "internal"
+)
+
+// Envelope is the frame format used in both directions on a chat socket.
+type Envelope struct {
+	Type     string          `json:"type"`
+	Version  int             `json:"version"`
+	ClientID string          `json:"client_id,omitempty"`
+	Room     string          `json:"room,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// ProtocolError is reported back to the sender as an error frame.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func protocolErrorf(code string, format string, args ...any) *ProtocolError {
+	return &ProtocolError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// payload is implemented by every inbound event payload.
+type payload interface {
+	validate() error
+}
+
+// ChatSendPayload is a new message, or a reply in the thread of ParentID.
+// A reply with AlsoInRoom is shown in the room's timeline too.
+type ChatSendPayload struct {
+	Content    string `json:"content"`
+	ParentID   string `json:"parent_id,omitempty"`
+	AlsoInRoom bool   `json:"also_in_room,omitempty"`
+}
+
+func (p *ChatSendPayload) validate() error {
+	p.Content = strings.TrimSpace(p.Content)
+	return validateContent(p.Content)
+}
+
+type ChatEditPayload struct {
+	MessageID string `json:"message_id"`
+	Content   string `json:"content"`
+}
+
+func (p *ChatEditPayload) validate() error {
+	if p.MessageID == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "message_id is required")
+	}
+	p.Content = strings.TrimSpace(p.Content)
+	return validateContent(p.Content)
+}
+
+type ChatDeletePayload struct {
+	MessageID string `json:"message_id"`
+}
+
+func (p *ChatDeletePayload) validate() error {
+	if p.MessageID == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "message_id is required")
+	}
+	return nil
+}
+
+// ThreadPayload is the payload of thread.subscribe and thread.unsubscribe,
+// and of their replies: the first message of the thread.
+type ThreadPayload struct {
+	MessageID string `json:"message_id"`
+}
+
+func (p *ThreadPayload) validate() error {
+	if p.MessageID == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "message_id is required")
+	}
+	return nil
+}
+
+// ReactionPayload adds the user's Emoji reaction to a message, or removes
+// it if it is there.
+type ReactionPayload struct {
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji"`
+}
+
+func (p *ReactionPayload) validate() error {
+	if p.MessageID == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "message_id is required")
+	}
+	if p.Emoji == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "emoji is required")
+	}
+	return nil
+}
+
+// TypingPayload is the empty payload of typing.start and typing.stop.
+type TypingPayload struct{}
+
+func (p *TypingPayload) validate() error {
+	return nil
+}
+
+// SubscribePayload follows the envelope's room on a multiplexed connection,
+// replaying what was missed since LastID if set.
+type SubscribePayload struct {
+	LastID string `json:"last_id"`
+}
+
+func (p *SubscribePayload) validate() error {
+	return nil
+}
+
+// UnsubscribePayload is the empty payload of room.unsubscribe.
+type UnsubscribePayload struct{}
+
+func (p *UnsubscribePayload) validate() error {
+	return nil
+}
+
+func validateContent(content string) error {
+	if content == "" {
+		return protocolErrorf(ErrCodeInvalidPayload, "content can't be empty")
+	}
+	if utf8.RuneCountInString(content) > maxContentLength {
+		return protocolErrorf(ErrCodeInvalidPayload, "content exceeds %d characters", maxContentLength)
+	}
+	return nil
+}
+
+// ChatMessage is the payload of an outbound chat.message event, and of
+// chat.edited with the new content of an edited message. Kind is "user"
+// for what members write and "system" for events the server records, such
+// as joins, leaves and renames; SenderID is who caused those. A deleted
+// message is a tombstone with DeletedAt set and no content.
+//
+// A reply has the ParentID of its thread and is sent as thread.reply to
+// the thread's subscribers, and as chat.message too if it was also sent to
+// the room. The first message of a thread carries its ReplyCount and
+// LastReplyAt.
+type ChatMessage struct {
+	ID        string     `json:"id,omitempty"`
+	RoomID    string     `json:"room_id"`
+	SenderID  string     `json:"sender_id"`
+	Email     string     `json:"email"`
+	Content   string     `json:"content"`
+	CreatedAt time.Time  `json:"created_at"`
+	Kind      string     `json:"kind"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	ParentID    string     `json:"parent_id,omitempty"`
+	ReplyCount  int64      `json:"reply_count,omitempty"`
+	LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+}
+
+// editedAt is when the message was last edited, zero if it never was.
+func (m *ChatMessage) editedAt() time.Time {
+	if m.EditedAt == nil {
+		return time.Time{}
+	}
+	return *m.EditedAt
+}
+
+// ThreadSummary is the payload of thread.updated, sent to the whole room
+// when a thread gets a reply.
+type ThreadSummary struct {
+	ID          string    `json:"id"`
+	RoomID      string    `json:"room_id"`
+	ReplyCount  int64     `json:"reply_count"`
+	LastReplyAt time.Time `json:"last_reply_at"`
+}
+
+// ReactionUpdated tells the room UserID added or removed an Emoji reaction
+// to a message, leaving Count of them.
+type ReactionUpdated struct {
+	MessageID string `json:"message_id"`
+	RoomID    string `json:"room_id"`
+	UserID    string `json:"user_id"`
+	Emoji     string `json:"emoji"`
+	Count     int64  `json:"count"`
+	Added     bool   `json:"added"`
+}
+
+// MessageDeleted tells the room a message was deleted, leaving a
+// tombstone, or purged, leaving nothing.
+type MessageDeleted struct {
+	ID        string    `json:"id"`
+	RoomID    string    `json:"room_id"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Purged    bool      `json:"purged,omitempty"`
+}
+
+// ChatAck confirms to the sender that the chat.send with the envelope's
+// client_id is stored as message ID. Acks of reaction.toggle have no
+// CreatedAt.
+type ChatAck struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+}
+
+// Typing tells the room a member started or stopped composing.
+type Typing struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+	Typing bool   `json:"typing"`
+}
+
+// Member is a user connected to a room, the payload of presence events.
+type Member struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// SessionResumed is sent once the messages missed since LastID have been
+// replayed; live traffic follows it.
+type SessionResumed struct {
+	LastID   string `json:"last_id"`
+	Replayed int    `json:"replayed"`
+}
+
+// SessionResync tells a resuming client the gap since LastID can't be
+// replayed and it has to reload the room.
+type SessionResync struct {
+	LastID string `json:"last_id,omitempty"`
+	Reason string `json:"reason"`
+	// Missed is how many messages were dropped because the client fell
+	// behind.
+	Missed int `json:"missed,omitempty"`
+}
+
+// Subscription lists the rooms a multiplexed connection follows after a
+// room.subscribe or room.unsubscribe.
+type Subscription struct {
+	Rooms []string `json:"rooms"`
+}
+
+// RoomClosed tells the clients of a room that its hub stopped, because the
+// room was deleted or the server is restarting. On a restart Reconnect is
+// set and RetryAfterMs spreads the clients' reconnects.
+type RoomClosed struct {
+	Reason       string `json:"reason"`
+	Reconnect    bool   `json:"reconnect,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+}
+
+// Announcement is a notice from the admins, such as planned maintenance,
+// shown until ExpiresAt. Scoped announcements are for the rooms they were
+// sent to only, the others for everyone. A client following several rooms
+// gets each announcement once.
+type Announcement struct {
+	ID        string    `json:"id"`
+	Severity  string    `json:"severity"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Scoped    bool      `json:"scoped,omitempty"`
+}
+
+// Mention tells the users in UserIDs they were mentioned in a message. It
+// reaches them in whatever rooms they are connected to, once per
+// connection, and nobody else.
+type Mention struct {
+	MessageID string    `json:"message_id"`
+	RoomID    string    `json:"room_id"`
+	RoomName  string    `json:"room_name"`
+	ParentID  string    `json:"parent_id,omitempty"`
+	SenderID  string    `json:"sender_id"`
+	Email     string    `json:"email"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+	UserIDs   []string  `json:"user_ids"`
+}
+
+type eventType struct {
+	newPayload func() payload
+	handle     func(c *Client, env *Envelope, p payload) error
+}
+
+// events is the registry of inbound event types a client may send.
+var events = map[string]eventType{
+	EventChatSend: {
+		newPayload: func() payload { return &ChatSendPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleChatSend(env, p.(*ChatSendPayload))
+		},
+	},
+	EventChatEdit: {
+		newPayload: func() payload { return &ChatEditPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleChatEdit(env, p.(*ChatEditPayload))
+		},
+	},
+	EventChatDelete: {
+		newPayload: func() payload { return &ChatDeletePayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleChatDelete(env, p.(*ChatDeletePayload))
+		},
+	},
+	EventTypingStart: {
+		newPayload: func() payload { return &TypingPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleTyping(env, true)
+		},
+	},
+	EventTypingStop: {
+		newPayload: func() payload { return &TypingPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleTyping(env, false)
+		},
+	},
+	EventSubscribe: {
+		newPayload: func() payload { return &SubscribePayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleSubscribe(env, p.(*SubscribePayload))
+		},
+	},
+	EventUnsubscribe: {
+		newPayload: func() payload { return &UnsubscribePayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleUnsubscribe(env)
+		},
+	},
+	EventThreadSubscribe: {
+		newPayload: func() payload { return &ThreadPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleThreadSubscribe(env, p.(*ThreadPayload))
+		},
+	},
+	EventThreadUnsubscribe: {
+		newPayload: func() payload { return &ThreadPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleThreadUnsubscribe(env, p.(*ThreadPayload))
+		},
+	},
+	EventReactionToggle: {
+		newPayload: func() payload { return &ReactionPayload{} },
+		handle: func(c *Client, env *Envelope, p payload) error {
+			return c.handleReactionToggle(env, p.(*ReactionPayload))
+		},
+	},
+}
+
+// htmxFrame is what the htmx ws extension sends for a ws-send element: the
+// form fields and hx-vals flattened into one object next to a HEADERS
+// object. A "type" value picks the event, and the other fields are its
+// payload; without one it is a chat.send of chat_message, a reply if
+// parent_id is set, also shown in the room if the also_in_room checkbox is.
+type htmxFrame struct {
+	ChatMessage *string         `json:"chat_message"`
+	ParentID    string          `json:"parent_id"`
+	AlsoInRoom  string          `json:"also_in_room"`
+	Headers     json.RawMessage `json:"HEADERS"`
+}
+
+// decodeFrame parses and validates a raw inbound frame. Legacy htmx form
+// frames are translated into an envelope.
+func decodeFrame(raw []byte) (*Envelope, payload, error) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return nil, nil, protocolErrorf(ErrCodeBadFrame, "frame is not a valid JSON envelope")
+	}
+
+	var form htmxFrame
+	if err := json.Unmarshal(raw, &form); err == nil && form.Headers != nil {
+		if env.Type == "" && form.ChatMessage != nil {
+			env.Type = EventChatSend
+			env.Payload, _ = json.Marshal(ChatSendPayload{
+				Content:    *form.ChatMessage,
+				ParentID:   form.ParentID,
+				AlsoInRoom: form.AlsoInRoom != "",
+			})
+		}
+		if env.Version == 0 {
+			env.Version = ProtocolVersion
+		}
+		if len(env.Payload) == 0 {
+			env.Payload = raw
+		}
+	}
+
+	if env.Type == "" {
+		return nil, nil, protocolErrorf(ErrCodeBadFrame, "type is required")
+	}
+
+	if len(env.ClientID) > maxClientIDLength {
+		return nil, nil, protocolErrorf(ErrCodeBadFrame, "client_id exceeds %d characters", maxClientIDLength)
+	}
+
+	if env.Version != ProtocolVersion {
+		return &env, nil, protocolErrorf(ErrCodeUnsupportedVersion, "version %d is not supported, expected %d", env.Version, ProtocolVersion)
+	}
+
+	et, ok := events[env.Type]
+	if !ok {
+		return &env, nil, protocolErrorf(ErrCodeUnknownType, "unknown event type %q", env.Type)
+	}
+
+	p := et.newPayload()
+	if len(env.Payload) == 0 {
+		return &env, nil, protocolErrorf(ErrCodeInvalidPayload, "payload is required")
+	}
+	if err := json.Unmarshal(env.Payload, p); err != nil {
+		return &env, nil, protocolErrorf(ErrCodeInvalidPayload, "payload does not match %s", env.Type)
+	}
+	if err := p.validate(); err != nil {
+		return &env, nil, err
+	}
+	return &env, p, nil
+}
+
+// newFrame marshals an outbound envelope around v.
+func newFrame(typ string, clientID string, room string, v any) ([]byte, error) {
+	p, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{
+		Type:     typ,
+		Version:  ProtocolVersion,
+		ClientID: clientID,
+		Room:     room,
+		Payload:  p,
+	})
+}
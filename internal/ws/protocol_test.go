@@ -0,0 +1,54 @@
+package ws
+
+import (
+	"testing"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		typ     string
+		errCode string
+	}{
+		{"envelope", `{"type":"chat.send","version":1,"payload":{"content":" hi "}}`, EventChatSend, ""},
+		{"htmx form", `{"chat_message":"hi","HEADERS":{"HX-Request":"true"}}`, EventChatSend, ""},
+		{"htmx typing", `{"type":"typing.start","chat_message":"hi","HEADERS":{}}`, EventTypingStart, ""},
+		{"htmx reply", `{"chat_message":"hi","parent_id":"m1","also_in_room":"true","HEADERS":{}}`, EventChatSend, ""},
+		{"htmx thread", `{"type":"thread.subscribe","message_id":"m1","HEADERS":{}}`, EventThreadSubscribe, ""},
+		{"htmx reaction", `{"type":"reaction.toggle","message_id":"m1","emoji":"👍","HEADERS":{}}`, EventReactionToggle, ""},
+		{"reaction without emoji", `{"type":"reaction.toggle","version":1,"payload":{"message_id":"m1"}}`, "", ErrCodeInvalidPayload},
+		{"not json", `hello`, "", ErrCodeBadFrame},
+		{"missing type", `{"version":1}`, "", ErrCodeBadFrame},
+		{"wrong version", `{"type":"chat.send","version":9,"payload":{"content":"hi"}}`, "", ErrCodeUnsupportedVersion},
+		{"unknown type", `{"type":"chat.shout","version":1,"payload":{}}`, "", ErrCodeUnknownType},
+		{"empty content", `{"type":"chat.send","version":1,"payload":{"content":"  "}}`, "", ErrCodeInvalidPayload},
+		{"missing payload", `{"type":"chat.delete","version":1}`, "", ErrCodeInvalidPayload},
+		{"bad payload", `{"type":"chat.send","version":1,"payload":{"content":1}}`, "", ErrCodeInvalidPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, p, err := decodeFrame([]byte(tt.raw))
+			if tt.errCode != "" {
+				perr, ok := err.(*ProtocolError)
+				if !ok || perr.Code != tt.errCode {
+					t.Errorf("decodeFrame() error = %v, want code %s", err, tt.errCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("decodeFrame() error = %v", err)
+				return
+			}
+			if env.Type != tt.typ {
+				t.Errorf("decodeFrame() type = %s, want %s", env.Type, tt.typ)
+			}
+			if send, ok := p.(*ChatSendPayload); ok && send.Content != "hi" {
+				t.Errorf("decodeFrame() content = %q, want %q", send.Content, "hi")
+			}
+			if send, ok := p.(*ChatSendPayload); ok && send.ParentID != "" && !send.AlsoInRoom {
+				t.Errorf("decodeFrame() reply = %+v, want it also in the room", send)
+			}
+		})
+	}
+}
@@ -2,57 +2,435 @@ package ws
 
 import (
 	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/time/rate"
+)
+
+var (
+	typingTimeout  = 6 * time.Second // typing state expires without a fresh typing.start
+	typingThrottle = 2 * time.Second // minimum gap between typing events from one client
 )
 
 type Room struct {
-	id         string
-	clients    map[*Client]bool
-	broadcast  chan []byte
-	register   chan *Client
-	unregister chan *Client
+	id          string
+	clients     map[*Client]bool
+	broadcast   chan []byte
+	register    chan *Client
+	unregister  chan *Client
+	typing      chan typingUpdate
+	presenceReq chan chan []Member
+
+	// members counts the local connections of each user in the room;
+	// followers counts those of multiplexed connections following it from
+	// the room list, which don't make a user present.
+	members   map[string]*member
+	followers map[string]*member
+	// typingUntil is when each typing user's state expires.
+	typingUntil map[string]time.Time
+	// leaving are the members whose last connection is gone, recorded
+	// leaving once PresenceGrace passes without them coming back.
+	leaving map[string]departure
 
+	// refs counts the references handed out by RoomManager.Open; the hub
+	// is only idle without any.
+	refs atomic.Int64
+	// done is closed once Run returns.
+	done chan struct{}
+
+	// userLimits are the per-user token buckets of the room.
+	limitMu    sync.Mutex
+	userLimits map[string]*rate.Limiter
+
+	cfg     RoomConfig
 	manager *RoomManager
 }
 
+type typingUpdate struct {
+	client *Client
+	typing bool
+}
+
+type member struct {
+	email string
+	conns int
+}
+
+type departure struct {
+	email string
+	at    time.Time
+}
+
 func NewRoom(id string, manager *RoomManager) *Room {
 	return &Room{
-		id:         id,
-		clients:    make(map[*Client]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
+		id:          id,
+		clients:     make(map[*Client]bool),
+		broadcast:   make(chan []byte),
+		register:    make(chan *Client),
+		unregister:  make(chan *Client),
+		typing:      make(chan typingUpdate),
+		presenceReq: make(chan chan []Member),
+
+		members:     make(map[string]*member),
+		followers:   make(map[string]*member),
+		typingUntil: make(map[string]time.Time),
+		leaving:     make(map[string]departure),
 
+		done: make(chan struct{}),
+
+		userLimits: make(map[string]*rate.Limiter),
+
+		cfg:     manager.cfg.ForRoom(id),
 		manager: manager,
 	}
 }
 
+// Run serves the room until ctx is done, the room is closed through the
+// broker, or it has been idle for RoomIdleTimeout. Broadcasts from local
+// clients are published to the broker, and frames from the broker
+// subscription are fanned out to local clients.
 func (h *Room) Run(ctx context.Context) {
+	defer close(h.done)
+	defer h.manager.forget(h)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sub, err := h.manager.broker.Subscribe(ctx, h.id)
+	if err != nil {
+		log.Println("Error subscribing room to broker", h.id, err)
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	idleSince := time.Now()
 	for {
 		select {
 		case c := <-h.register:
 			h.clients[c] = true
+			h.join(ctx, c)
 		case c := <-h.unregister:
-			if _, ok := h.clients[c]; ok {
-				delete(h.clients, c)
-				close(c.send)
+			h.removeClient(ctx, c)
+		case u := <-h.typing:
+			// detached clients (HTTP posts) count if the user is connected
+			if h.connected(u.client.userID) {
+				h.setTyping(ctx, u.client.userID, u.client.email, u.typing)
 			}
-		case msg := <-h.broadcast:
-			for c := range h.clients {
-				select {
-				case c.send <- msg:
-				default:
-					// remove slow clients
-					delete(h.clients, c)
-					close(c.send)
+		case reply := <-h.presenceReq:
+			reply <- h.presence()
+		case <-ticker.C:
+			now := time.Now()
+			for userID, until := range h.typingUntil {
+				if now.After(until) {
+					h.setTyping(ctx, userID, h.memberEmail(userID), false)
 				}
 			}
-		case <-ctx.Done():
-			for c := range h.clients {
-				delete(h.clients, c)
-				close(c.send)
+			h.recordLeaving(now)
+			if len(h.clients) > 0 || h.refs.Load() > 0 {
+				idleSince = now
+			} else if now.Sub(idleSince) > h.manager.cfg.RoomIdleTimeout && h.manager.retire(h) {
+				log.Println("Chat room idle, stopping: ", h.id)
+				// nobody can come back to this hub
+				h.recordLeaving(time.Time{})
+				return
+			}
+		case msg := <-h.broadcast:
+			h.publish(ctx, msg)
+		case msg, ok := <-sub:
+			if !ok {
+				// closed once ctx is done
+				sub = nil
+				continue
+			}
+			f := newOutbound(msg)
+			h.fanOut(ctx, f)
+			if f.env.Type == EventRoomClosed {
+				log.Println("Chat room closed: ", h.id)
+				return
 			}
+		case <-ctx.Done():
+			h.closeClients(ctx, context.Cause(ctx))
 			return
+		}
+	}
+}
+
+// fanOut hands a frame to every local client. They share f, so it is
+// decoded and rendered once for all of them.
+func (h *Room) fanOut(ctx context.Context, f *outbound) {
+	for c := range h.clients {
+		if !h.deliver(c, f) {
+			h.removeClient(ctx, c)
+		}
+	}
+}
+
+// deliver queues msg for c. If c's buffer is full the room's slow consumer
+// policy applies; deliver returns false if c is being disconnected.
+func (h *Room) deliver(c *Client, msg *outbound) bool {
+	select {
+	case c.send <- msg:
+		return true
+	default:
+	}
+
+	policy := h.cfg.SlowConsumer
+	metrics.Add("slow_consumer_"+string(policy), 1)
+	switch policy {
+	case SlowConsumerDropOldest:
+		// other rooms of a multiplexed client may refill the buffer
+		for range 3 {
+			select {
+			case old := <-c.send:
+				if !old.droppable() {
+					// it can't go back ahead of the frames queued after it
+					c.kick(websocket.StatusTryAgainLater, protocolErrorf(ErrCodeSlowConsumer, "too slow to keep up with the room"))
+					return false
+				}
+				c.fellBehind(old.env.Room, old.env.Type == EventChatMessage)
+			default:
+			}
+			select {
+			case c.send <- msg:
+				return true
+			default:
+			}
+		}
+		// nothing could be evicted
+		c.fellBehind(h.id, msg.env.Type == EventChatMessage)
+		return true
+	case SlowConsumerResync:
+		c.fellBehind(h.id, msg.env.Type == EventChatMessage)
+		return true
+	default:
+		c.kick(websocket.StatusTryAgainLater, protocolErrorf(ErrCodeSlowConsumer, "too slow to keep up with the room"))
+		return false
+	}
+}
+
+// closeClients tells every local client why the hub stops. On a restart
+// each one gets its own reconnect delay within ReconnectJitter.
+func (h *Room) closeClients(ctx context.Context, cause error) {
+	closed := RoomClosed{Reason: cause.Error(), Reconnect: errors.Is(cause, ErrShuttingDown)}
+	jitter := h.manager.cfg.ReconnectJitter.Milliseconds()
+	for c := range h.clients {
+		if closed.Reconnect && jitter > 0 {
+			closed.RetryAfterMs = rand.Int64N(jitter)
+		}
+		frame, err := newFrame(EventRoomClosed, "", h.id, closed)
+		if err != nil {
+			log.Println("Error encoding", err)
+			continue
+		}
+		select {
+		case c.send <- newOutbound(frame):
+		default:
+			c.kick(websocket.StatusTryAgainLater, protocolErrorf(ErrCodeSlowConsumer, "too slow to keep up with the room"))
+			h.removeClient(ctx, c)
+		}
+	}
+}
+
+// offer hands v to the hub, or gives up if the hub has stopped.
+func offer[T any](h *Room, ch chan T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-h.done:
+		return false
+	}
+}
 
+// allowUser takes a token from the bucket userID shares across their
+// connections to the room.
+func (h *Room) allowUser(userID string) bool {
+	h.limitMu.Lock()
+	defer h.limitMu.Unlock()
+
+	l, ok := h.userLimits[userID]
+	if !ok {
+		l = newLimiter(h.cfg.UserRate, h.cfg.UserBurst)
+		h.userLimits[userID] = l
+	}
+	return l.Allow()
+}
+
+func newLimiter(r float64, burst int) *rate.Limiter {
+	if r <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(r), max(burst, 1))
+}
+
+// stopped reports whether Run has returned.
+func (h *Room) stopped() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Presence returns the members connected to this room through this
+// instance, or nil if ctx is done first.
+func (h *Room) Presence(ctx context.Context) []Member {
+	reply := make(chan []Member, 1)
+	select {
+	case h.presenceReq <- reply:
+		return <-reply
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (h *Room) removeClient(ctx context.Context, c *Client) {
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	delete(h.clients, c)
+	h.leave(ctx, c)
+}
+
+// join counts a new connection of c's user and announces the user when it
+// is their first one bound to the room. The user entering the room is
+// recorded as a system event, unless they are back within PresenceGrace.
+// Connections following the room from the room list are counted apart.
+func (h *Room) join(ctx context.Context, c *Client) {
+	members := h.members
+	if c.hub != h {
+		members = h.followers
+	}
+	m, ok := members[c.userID]
+	if !ok {
+		m = &member{email: c.email}
+		members[c.userID] = m
+	}
+	m.conns++
+	if c.hub == h && m.conns == 1 {
+		if _, back := h.leaving[c.userID]; back {
+			delete(h.leaving, c.userID)
+		} else {
+			h.recordPresence(c.userID, c.email, true)
+		}
+		h.publishEvent(ctx, EventPresenceJoin, Member{UserID: c.userID, Email: c.email})
+	}
+}
+
+// leave is the counterpart of join, announcing the user once their last
+// connection bound to the room is gone. They are recorded leaving once
+// PresenceGrace passes.
+func (h *Room) leave(ctx context.Context, c *Client) {
+	members := h.members
+	if c.hub != h {
+		members = h.followers
+	}
+	m, ok := members[c.userID]
+	if !ok {
+		return
+	}
+	m.conns--
+	if m.conns > 0 {
+		return
+	}
+	delete(members, c.userID)
+	if !h.connected(c.userID) {
+		h.setTyping(ctx, c.userID, c.email, false)
+	}
+	if c.hub == h {
+		h.leaving[c.userID] = departure{email: c.email, at: time.Now().Add(h.manager.cfg.PresenceGrace)}
+		h.publishEvent(ctx, EventPresenceLeave, Member{UserID: c.userID, Email: c.email})
+	}
+}
+
+// connected reports whether userID has a local connection in or following
+// the room.
+func (h *Room) connected(userID string) bool {
+	_, member := h.members[userID]
+	_, follower := h.followers[userID]
+	return member || follower
+}
+
+// recordLeaving records the members gone since before now leaving, all of
+// them if now is zero.
+func (h *Room) recordLeaving(now time.Time) {
+	for userID, d := range h.leaving {
+		if now.IsZero() || now.After(d.at) {
+			delete(h.leaving, userID)
+			h.recordPresence(userID, d.email, false)
 		}
 	}
 }
+
+// recordPresence records a user entering or leaving the room without
+// holding up the hub. Nothing is recorded once the manager shuts down, so
+// a restart doesn't read as everyone leaving.
+func (h *Room) recordPresence(userID string, email string, entered bool) {
+	if !h.manager.beginSend() {
+		return
+	}
+	go func() {
+		defer h.manager.endSend()
+		if err := h.manager.RecordPresence(context.Background(), h.id, userID, email, entered); err != nil {
+			log.Println("Error recording room presence", h.id, err)
+		}
+	}()
+}
+
+// setTyping records a user's typing state and broadcasts changes only.
+func (h *Room) setTyping(ctx context.Context, userID string, email string, typing bool) {
+	_, wasTyping := h.typingUntil[userID]
+	if typing {
+		h.typingUntil[userID] = time.Now().Add(typingTimeout)
+	} else {
+		delete(h.typingUntil, userID)
+	}
+	if typing != wasTyping {
+		h.publishEvent(ctx, EventTyping, Typing{UserID: userID, Email: email, Typing: typing})
+	}
+}
+
+func (h *Room) presence() []Member {
+	members := make([]Member, 0, len(h.members))
+	for userID, m := range h.members {
+		members = append(members, Member{UserID: userID, Email: m.email})
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Email < members[j].Email })
+	return members
+}
+
+func (h *Room) memberEmail(userID string) string {
+	if m, ok := h.members[userID]; ok {
+		return m.email
+	}
+	if m, ok := h.followers[userID]; ok {
+		return m.email
+	}
+	return ""
+}
+
+func (h *Room) publishEvent(ctx context.Context, typ string, v any) {
+	frame, err := newFrame(typ, "", h.id, v)
+	if err != nil {
+		log.Println("Error encoding", err)
+		return
+	}
+	h.publish(ctx, frame)
+}
+
+func (h *Room) publish(ctx context.Context, frame []byte) {
+	if err := h.manager.broker.Publish(ctx, h.id, frame); err != nil {
+		log.Println("Error publishing to broker", h.id, err)
+	}
+}
@@ -4,58 +4,418 @@ import (
 	"context"
 	"errors"
 	"log"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"rplatform-echo/internal/services"
 )
 
+// ErrShuttingDown is returned once RoomManager.Shutdown has started. It is
+// also the cause hubs are stopped with, telling clients to reconnect.
+var ErrShuttingDown = errors.New("server restarting")
+
+// RoomManager runs a hub per room in use. Hubs are started by Open and
+// stop on their own once nobody used them for Config.RoomIdleTimeout, when
+// their room is deleted, or when the manager shuts down.
 type RoomManager struct {
 	rooms map[string]*Room
 	mu    sync.RWMutex
+	// closing is set under mu once Shutdown starts; no hubs or client
+	// pumps are started after that.
+	closing bool
+
+	// ctx is the parent of every hub context.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	// wg tracks hubs, pumps tracks the client write pumps.
+	wg    sync.WaitGroup
+	pumps sync.WaitGroup
+	// sending is read-locked by every chat send being stored, so Shutdown
+	// can wait for them by taking the write lock.
+	sending sync.RWMutex
+
+	// clients are the local connections of each user, which
+	// notifications go to.
+	clientsMu sync.Mutex
+	clients   map[string]map[*Client]bool
 
+	// abuseStates are the users' violations and mutes, swept of idle
+	// users every violationWindow.
+	abuseMu     sync.Mutex
+	abuseStates map[string]*abuseState
+	abuseSwept  time.Time
+
+	roomSvc    *services.RoomService
 	messageSvc *services.MessageService
+	// tokenSvc tells revoked sessions apart; without it only expiry is
+	// enforced.
+	tokenSvc *services.TokenService
+	// announcementSvc has the announcements shown to clients as they
+	// join a room, if set.
+	announcementSvc *services.AnnouncementService
+	broker          Broker
+	cfg             Config
 }
 
-func NewRoomManager(messageSvc *services.MessageService) *RoomManager {
-	return &RoomManager{
-		rooms: make(map[string]*Room),
+func NewRoomManager(ctx context.Context, roomSvc *services.RoomService, messageSvc *services.MessageService, tokenSvc *services.TokenService, announcementSvc *services.AnnouncementService, broker Broker, cfg Config) *RoomManager {
+	ctx, cancel := context.WithCancelCause(ctx)
+	m := &RoomManager{
+		rooms:       make(map[string]*Room),
+		clients:     make(map[string]map[*Client]bool),
+		abuseStates: make(map[string]*abuseState),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		roomSvc:         roomSvc,
+		messageSvc:      messageSvc,
+		tokenSvc:        tokenSvc,
+		announcementSvc: announcementSvc,
+		broker:          broker,
+		cfg:             cfg,
+	}
+
+	sub, err := broker.Subscribe(ctx, notificationTopic)
+	if err != nil {
+		log.Println("Error subscribing to notifications", err)
+		return m
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.deliverNotifications(sub)
+	}()
+	return m
+}
 
-		messageSvc: messageSvc,
+// Open returns the hub of an existing room, starting it if needed. It
+// returns sql.ErrNoRows if there is no such room and ErrShuttingDown once
+// Shutdown started. The caller holds a reference to the hub until it
+// calls Release.
+func (m *RoomManager) Open(ctx context.Context, roomID string) (*Room, error) {
+	if _, err := m.roomSvc.Get(ctx, roomID); err != nil {
+		return nil, err
 	}
+	return m.acquire(roomID)
+}
+
+// Release gives back a reference taken by Open.
+func (m *RoomManager) Release(room *Room) {
+	room.refs.Add(-1)
 }
 
-func (m *RoomManager) GetRoom(roomID string) *Room {
+func (m *RoomManager) acquire(roomID string) (*Room, error) {
 	m.mu.RLock()
 	room, ok := m.rooms[roomID]
+	closing := m.closing
+	if ok && !closing {
+		room.refs.Add(1)
+	}
 	m.mu.RUnlock()
+	if closing {
+		return nil, ErrShuttingDown
+	}
 	if ok {
-		return room
+		return room, nil
 	}
 
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.closing {
+		return nil, ErrShuttingDown
+	}
 	if room, ok := m.rooms[roomID]; ok {
-		return room
+		room.refs.Add(1)
+		return room, nil
 	}
 
 	room = NewRoom(roomID, m)
+	room.refs.Add(1)
 	m.rooms[roomID] = room
 	log.Println("New chat room created: ", roomID)
 
-	go room.Run(context.Background())
-	return room
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		room.Run(m.ctx)
+	}()
+	return room, nil
 }
 
-func (m *RoomManager) RemoveRoom(roomID string) error {
+// track counts a client write pump until it calls done, unless Shutdown
+// started.
+func (m *RoomManager) track() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closing {
+		return false
+	}
+	m.pumps.Add(1)
+	return true
+}
+
+// beginSend marks a chat send being stored, unless Shutdown started.
+func (m *RoomManager) beginSend() bool {
+	return m.sending.TryRLock()
+}
+
+func (m *RoomManager) endSend() {
+	m.sending.RUnlock()
+}
+
+// retire removes an idle hub unless it was handed out again meanwhile.
+func (m *RoomManager) retire(room *Room) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if room.refs.Load() > 0 {
+		return false
+	}
+	m.forgetLocked(room)
+	return true
+}
+
+// forget removes a stopped hub.
+func (m *RoomManager) forget(room *Room) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.forgetLocked(room)
+}
+
+func (m *RoomManager) forgetLocked(room *Room) {
+	if m.rooms[room.id] == room {
+		delete(m.rooms, room.id)
+	}
+}
+
+// RemoveRoom closes the hubs of a deleted room on every instance sharing
+// the broker. Their clients get a room.closed event and single-room
+// sockets are closed.
+func (m *RoomManager) RemoveRoom(ctx context.Context, roomID string) error {
+	frame, err := newFrame(EventRoomClosed, "", roomID, RoomClosed{Reason: "room deleted"})
+	if err != nil {
+		return err
+	}
+	return m.broker.Publish(ctx, roomID, frame)
+}
+
+// RecordEvent stores a system event of a room, such as a member joining or
+// the room being renamed, and broadcasts it on every instance sharing the
+// broker. userID and email are who caused it.
+func (m *RoomManager) RecordEvent(ctx context.Context, roomID string, userID string, email string, content string) error {
+	msg, err := m.messageSvc.CreateSystem(ctx, roomID, userID, content)
+	if err != nil {
+		return err
+	}
+	frame, err := newFrame(EventChatMessage, "", roomID, newChatMessage(msg, email))
+	if err != nil {
+		return err
+	}
+	return m.broker.Publish(ctx, roomID, frame)
+}
+
+// RecordPresence records a user entering or leaving a room as a system
+// event, unless they already were in the room or out of it. The membership
+// is shared, so a user on several instances is recorded once.
+func (m *RoomManager) RecordPresence(ctx context.Context, roomID string, userID string, email string, entered bool) error {
+	change, content := m.roomSvc.Leave, email+" left the room"
+	if entered {
+		change, content = m.roomSvc.Enter, email+" joined the room"
+	}
+	changed, err := change(ctx, roomID, userID)
+	if err != nil || !changed {
+		return err
+	}
+	return m.RecordEvent(ctx, roomID, userID, email, content)
+}
+
+// Purged removes a purged message from the clients of its room on every
+// instance sharing the broker.
+func (m *RoomManager) Purged(ctx context.Context, roomID string, messageID string) error {
+	frame, err := newFrame(EventChatDeleted, "", roomID, MessageDeleted{
+		ID:        messageID,
+		RoomID:    roomID,
+		DeletedAt: time.Now().UTC(),
+		Purged:    true,
+	})
+	if err != nil {
+		return err
+	}
+	return m.broker.Publish(ctx, roomID, frame)
+}
+
+// isModerator reports whether email may delete anyone's messages. Emails
+// are compared lowercased, the way users are stored.
+func (m *RoomManager) isModerator(email string) bool {
+	return slices.Contains(m.cfg.Moderators, strings.ToLower(email))
+}
+
+// Announce pushes an announcement to the clients of roomIDs, or of every
+// room if there are none, on every instance sharing the broker.
+func (m *RoomManager) Announce(ctx context.Context, a Announcement, roomIDs []string) error {
+	if len(roomIDs) == 0 {
+		var err error
+		if roomIDs, err = m.allRooms(ctx); err != nil {
+			return err
+		}
+	}
+	return m.publish(ctx, EventAnnouncement, a, roomIDs)
+}
+
+// notificationTopic is where the broker carries frames for users rather
+// than rooms. Room ids are ULIDs, so it is no room's.
+const notificationTopic = "notifications"
+
+// Notify pushes a mention to the mentioned users' connections, whichever
+// rooms they are in, on every instance sharing the broker.
+func (m *RoomManager) Notify(ctx context.Context, mention Mention) error {
+	frame, err := newFrame(EventMention, "", mention.RoomID, mention)
+	if err != nil {
+		return err
+	}
+	return m.broker.Publish(ctx, notificationTopic, frame)
+}
+
+// deliverNotifications hands the notifications published on any instance
+// to the local connections of the users they are for, until sub closes.
+// Clients too slow to take one miss it; it is in their inbox anyway.
+func (m *RoomManager) deliverNotifications(sub <-chan []byte) {
+	for frame := range sub {
+		f := newOutbound(frame)
+		mention, ok := f.payload.(*Mention)
+		if !ok {
+			continue
+		}
+		m.clientsMu.Lock()
+		for _, userID := range mention.UserIDs {
+			for c := range m.clients[userID] {
+				select {
+				case c.send <- f:
+				default:
+					metrics.Add("notifications_dropped", 1)
+				}
+			}
+		}
+		m.clientsMu.Unlock()
+	}
+}
+
+// addClient makes a connection reachable by notifications for its user.
+func (m *RoomManager) addClient(c *Client) {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+
+	if m.clients[c.userID] == nil {
+		m.clients[c.userID] = make(map[*Client]bool)
+	}
+	m.clients[c.userID][c] = true
+}
+
+func (m *RoomManager) removeClient(c *Client) {
+	m.clientsMu.Lock()
+	defer m.clientsMu.Unlock()
+
+	delete(m.clients[c.userID], c)
+	if len(m.clients[c.userID]) == 0 {
+		delete(m.clients, c.userID)
+	}
+}
+
+// allRooms lists every room, since rooms may be in use on other instances
+// only.
+func (m *RoomManager) allRooms(ctx context.Context) ([]string, error) {
+	rooms, err := m.roomSvc.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roomIDs := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		roomIDs = append(roomIDs, r.ID)
+	}
+	return roomIDs, nil
+}
+
+// publish sends the same event to each of roomIDs.
+func (m *RoomManager) publish(ctx context.Context, typ string, v any, roomIDs []string) error {
+	var errs []error
+	for _, roomID := range roomIDs {
+		frame, err := newFrame(typ, "", roomID, v)
+		if err != nil {
+			return err
+		}
+		if err := m.broker.Publish(ctx, roomID, frame); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown drains the hubs for a restart. It stops taking new clients and
+// chat sends, waits for the sends being stored so they reach their rooms,
+// then closes every client with StatusServiceRestart and a reconnect hint.
+// It returns ctx's error if that doesn't finish before ctx is done.
+func (m *RoomManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		m.sending.Lock()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-ctx.Done():
+		log.Println("Chat sends still being stored at shutdown")
+	}
+
+	m.cancel(ErrShuttingDown)
+
+	stopped := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		m.pumps.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Presence lists the members of a room on every instance, as recorded by
+// RecordPresence, along with those connected through this one whose
+// entering may not be recorded yet.
+func (m *RoomManager) Presence(ctx context.Context, roomID string) ([]Member, error) {
+	users, err := m.roomSvc.Users(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, len(users))
+	seen := make(map[string]bool, len(users))
+	for _, u := range users {
+		members = append(members, Member{UserID: u.ID, Email: u.Email})
+		seen[u.ID] = true
+	}
+
 	m.mu.RLock()
-	if _, ok := m.rooms[roomID]; ok {
-		delete(m.rooms, roomID)
-	} else {
-		return errors.New("Room does not exist")
+	room, ok := m.rooms[roomID]
+	m.mu.RUnlock()
+	if ok {
+		for _, member := range room.Presence(ctx) {
+			if !seen[member.UserID] {
+				members = append(members, member)
+			}
+		}
 	}
-	return nil
+	slices.SortFunc(members, func(a, b Member) int { return strings.Compare(a.Email, b.Email) })
+	return members, nil
 }
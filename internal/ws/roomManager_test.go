@@ -0,0 +1,83 @@
+package ws
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"rplatform-echo/internal/repository"
+	"rplatform-echo/internal/services"
+)
+
+func TestNotify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := NewRoomManager(ctx, nil, nil, nil, nil, NewMemoryBroker(), DefaultConfig())
+
+	mentioned := &Client{userID: "u1", send: make(chan *outbound, 1)}
+	other := &Client{userID: "u2", send: make(chan *outbound, 1)}
+	m.addClient(mentioned)
+	m.addClient(other)
+
+	if err := m.Notify(ctx, Mention{MessageID: "m1", RoomID: "room", UserIDs: []string{"u1"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-mentioned.send:
+		if mention, ok := f.payload.(*Mention); !ok || mention.MessageID != "m1" {
+			t.Errorf("got %s, want the mention of m1", f.raw)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mentioned user not notified")
+	}
+	select {
+	case f := <-other.send:
+		t.Errorf("user not mentioned got %s", f.raw)
+	default:
+	}
+
+	m.removeClient(mentioned)
+	if len(m.clients["u1"]) != 0 {
+		t.Error("client still reachable after removeClient")
+	}
+}
+
+func TestPresenceAcrossInstances(t *testing.T) {
+	db := openDB(t, `insert into users (id, name, email, password) values ('u1', 'a@x', 'a@x', 'pw'), ('u2', 'b@x', 'b@x', 'pw');
+		insert into rooms (id, name) values ('r1', 'one');
+		insert into room_users (room_id, user_id) values ('r1', 'u2');`)
+	ctx := context.Background()
+	q := repository.New(db)
+	newManager := func() *RoomManager {
+		m := NewRoomManager(ctx, services.NewRoomService(q), services.NewMessageService(db, q, nil), nil, nil, NewMemoryBroker(), DefaultConfig())
+		t.Cleanup(func() { m.Shutdown(ctx) })
+		return m
+	}
+	a, b := newManager(), newManager()
+
+	room, err := a.Open(ctx, "r1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Release(room)
+	room.register <- &Client{userID: "u1", email: "a@x", hub: room, send: make(chan *outbound, 8)}
+
+	want := []Member{{UserID: "u1", Email: "a@x"}, {UserID: "u2", Email: "b@x"}}
+	deadline := time.Now().Add(3 * time.Second)
+	for _, m := range []*RoomManager{a, b} {
+		for {
+			got, err := m.Presence(ctx, "r1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if slices.Equal(got, want) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Presence = %v, want %v", got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package ws
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func waitStopped(t *testing.T, room *Room) {
+	t.Helper()
+	select {
+	case <-room.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for hub to stop")
+	}
+}
+
+func TestRoomStopsWhenIdle(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.RoomIdleTimeout = 10 * time.Millisecond
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), cfg)
+	defer m.Shutdown(context.Background())
+
+	room, _ := m.acquire("room")
+	time.Sleep(1200 * time.Millisecond)
+	if room.stopped() {
+		t.Fatal("hub stopped while referenced")
+	}
+
+	m.Release(room)
+	waitStopped(t, room)
+	if again, _ := m.acquire("room"); again == room {
+		t.Error("acquire() returned the stopped hub")
+	}
+}
+
+func TestRemoveRoomStopsHub(t *testing.T) {
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), DefaultConfig())
+	defer m.Shutdown(context.Background())
+
+	room, _ := m.acquire("room")
+	// let the hub subscribe before publishing the close
+	time.Sleep(50 * time.Millisecond)
+	if err := m.RemoveRoom(context.Background(), "room"); err != nil {
+		t.Fatalf("RemoveRoom() error = %v", err)
+	}
+	waitStopped(t, room)
+	m.Release(room)
+}
+
+func TestShutdownStopsHubs(t *testing.T) {
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), DefaultConfig())
+	a, _ := m.acquire("a")
+	b, _ := m.acquire("b")
+
+	// a chat send being stored holds up the shutdown
+	if !m.beginSend() {
+		t.Fatal("beginSend() = false before Shutdown")
+	}
+	done := make(chan error)
+	go func() { done <- m.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+	if a.stopped() {
+		t.Error("hub stopped while a chat send was being stored")
+	}
+	m.endSend()
+
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if !a.stopped() || !b.stopped() {
+		t.Error("Shutdown() returned before hubs stopped")
+	}
+	if _, err := m.acquire("c"); err != ErrShuttingDown {
+		t.Errorf("acquire() after Shutdown error = %v, want %v", err, ErrShuttingDown)
+	}
+	if m.beginSend() {
+		t.Error("beginSend() = true after Shutdown")
+	}
+}
+
+func TestDeliverSlowConsumer(t *testing.T) {
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), DefaultConfig())
+	raw, _ := newFrame(EventChatMessage, "", "room", ChatMessage{ID: "2"})
+	msg := newOutbound(raw)
+	raw, _ = newFrame(EventChatMessage, "", "room", ChatMessage{ID: "1"})
+	oldMsg := newOutbound(raw)
+	raw, _ = newFrame(EventChatAck, "c1", "room", ChatAck{ID: "1"})
+	ack := newOutbound(raw)
+
+	// the client's buffer holds two frames, and deliver must not reorder
+	// them
+	tests := []struct {
+		policy SlowConsumerPolicy
+		queued []*outbound
+		kept   bool
+		want   []*outbound
+	}{
+		{SlowConsumerDisconnect, []*outbound{oldMsg, ack}, false, nil},
+		{SlowConsumerDropOldest, []*outbound{oldMsg, ack}, true, []*outbound{ack, msg}},
+		{SlowConsumerDropOldest, []*outbound{ack, oldMsg}, false, nil},
+		{SlowConsumerResync, []*outbound{oldMsg, ack}, true, []*outbound{oldMsg, ack}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy)+"/"+tt.queued[0].env.Type, func(t *testing.T) {
+			room := NewRoom("room", m)
+			room.cfg.SlowConsumer = tt.policy
+			c := &Client{
+				send:   make(chan *outbound, len(tt.queued)),
+				kicked: make(chan struct{}),
+				behind: make(chan struct{}, 1),
+				missed: make(map[string]int),
+			}
+			for _, f := range tt.queued {
+				c.send <- f
+			}
+
+			if kept := room.deliver(c, msg); kept != tt.kept {
+				t.Fatalf("deliver() = %v, want %v", kept, tt.kept)
+			}
+			if !tt.kept {
+				select {
+				case <-c.kicked:
+				default:
+					t.Error("slow client not kicked")
+				}
+				return
+			}
+			close(c.send)
+			var queued []*outbound
+			for f := range c.send {
+				queued = append(queued, f)
+			}
+			if !slices.Equal(queued, tt.want) {
+				t.Errorf("queued %d frames, want %d in order", len(queued), len(tt.want))
+				for i, f := range queued {
+					t.Logf("#%d %s", i, f.raw)
+				}
+			}
+			if len(c.behind) != 1 || c.missed["room"] != 1 {
+				t.Errorf("behind = %d, missed = %v, want 1 message in room", len(c.behind), c.missed)
+			}
+		})
+	}
+}
+
+func TestFollowersAreNotPresent(t *testing.T) {
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), DefaultConfig())
+	room := NewRoom("room", m)
+	follower := &Client{userID: "u1", email: "a@example.com"}
+
+	room.join(context.Background(), follower)
+	if got := room.presence(); len(got) != 0 {
+		t.Errorf("presence() = %v with a follower only, want none", got)
+	}
+	if !room.connected("u1") {
+		t.Error("connected() = false for a follower")
+	}
+	room.leave(context.Background(), follower)
+	if room.connected("u1") {
+		t.Error("connected() = true after the follower left")
+	}
+}
+
+func TestLeavingWithinGrace(t *testing.T) {
+	m := NewRoomManager(context.Background(), nil, nil, nil, nil, NewMemoryBroker(), DefaultConfig())
+	// as if shutting down, so nothing reaches the missing services
+	m.sending.Lock()
+	room := NewRoom("room", m)
+	c := &Client{userID: "u1", email: "a@example.com", hub: room}
+	ctx := context.Background()
+
+	room.join(ctx, c)
+	room.leave(ctx, c)
+	if _, ok := room.leaving["u1"]; !ok {
+		t.Fatal("member not leaving after their last connection is gone")
+	}
+	room.join(ctx, c)
+	if _, ok := room.leaving["u1"]; ok {
+		t.Error("member still leaving after coming back within the grace period")
+	}
+
+	room.leave(ctx, c)
+	room.recordLeaving(time.Now())
+	if _, ok := room.leaving["u1"]; !ok {
+		t.Error("member recorded leaving before the grace period passed")
+	}
+	room.recordLeaving(time.Now().Add(m.cfg.PresenceGrace + time.Second))
+	if len(room.leaving) != 0 {
+		t.Errorf("leaving = %v after the grace period, want none", room.leaving)
+	}
+}
@@ -0,0 +1,289 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rplatform-echo/internal/services"
+
+	"github.com/coder/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// Maximum size of a frame posted over HTTP.
+const maxPostSize = 64 << 10
+
+// sseStream is the Server-Sent Events transport. chat.message events carry
+// the message id as event id, so a reconnecting EventSource presents it
+// back as Last-Event-ID.
+type sseStream struct {
+	mu sync.Mutex
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (t *sseStream) write(ctx context.Context, f *outbound, data []byte) error {
+	var b bytes.Buffer
+	if f.id != "" {
+		b.WriteString("id: " + f.id + "\n")
+	}
+	if f.env.Type == EventRoomClosed {
+		// the EventSource reconnects on its own after this delay
+		if closed := f.roomClosed(); closed.Reconnect {
+			b.WriteString("retry: " + strconv.FormatInt(closed.RetryAfterMs, 10) + "\n")
+		}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return t.flush(b.Bytes())
+}
+
+func (t *sseStream) ping(ctx context.Context) error {
+	return t.flush([]byte(": ping\n\n"))
+}
+
+func (t *sseStream) close(status websocket.StatusCode, reason string) {}
+
+func (t *sseStream) flush(b []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.rc.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return err
+	}
+	if _, err := t.w.Write(b); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// ServeSSE streams a room to the client as Server-Sent Events until the
+// request is done. It goes through the same hub, replay and rendering as
+// ServeWs; ?format=json selects JSON envelopes instead of htmx fragments.
+// With ?thread= set to the first message of a thread, the stream only has
+// the replies in that thread, since an SSE client can't subscribe to one
+// on the room's stream. It takes over the reference from RoomManager.Open.
+func ServeSSE(hub *Room, c echo.Context) error {
+	subprotocol := SubprotocolHTMX
+	if c.QueryParam("format") == "json" {
+		subprotocol = SubprotocolJSON
+	}
+
+	if err := checkOrigin(c.Request(), hub.manager.cfg.AllowedOrigins); err != nil {
+		hub.manager.Release(hub)
+		return err
+	}
+	thread := c.QueryParam("thread")
+	if thread != "" {
+		if err := checkThread(c.Request().Context(), hub, thread); err != nil {
+			hub.manager.Release(hub)
+			return err
+		}
+	}
+	if !hub.manager.track() {
+		hub.manager.Release(hub)
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrShuttingDown.Error())
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	stream := &sseStream{w: res, rc: http.NewResponseController(res)}
+	if err := stream.flush([]byte(": connected\n\n")); err != nil {
+		hub.manager.pumps.Done()
+		hub.manager.Release(hub)
+		return err
+	}
+
+	client := newClient(c.Request().Context(), hub.manager, hub, c, stream, subprotocol)
+	if thread != "" {
+		client.threadOnly = thread
+		client.threads[thread] = true
+	} else {
+		client.lastID = c.Request().Header.Get("Last-Event-ID")
+		if client.lastID == "" {
+			client.lastID = c.QueryParam("last_id")
+		}
+	}
+	log.Println("Client is registering", client.email, "sse", subprotocol)
+
+	go client.heartbeat()
+	client.writePump()
+	return nil
+}
+
+// checkThread checks that thread is the first message of a thread in the
+// room of hub.
+func checkThread(ctx context.Context, hub *Room, thread string) error {
+	msg, err := hub.manager.messageSvc.Get(ctx, hub.id, thread)
+	if errors.Is(err, services.ErrMessageNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if msg.ParentID.Valid {
+		return echo.NewHTTPError(http.StatusBadRequest, "message "+thread+" is a reply, follow thread "+msg.ParentID.String+" instead")
+	}
+	return nil
+}
+
+// checkOrigin refuses a request from a page on another host unless the
+// host matches one of patterns, the way websocket.Accept does for sockets.
+// Requests without an Origin header don't come from a browser page.
+func checkOrigin(r *http.Request, patterns []string) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "invalid origin")
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, pattern := range patterns {
+		target := u.Host
+		if strings.Contains(pattern, "://") {
+			target = u.Scheme + "://" + u.Host
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(target)); ok {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "origin "+origin+" is not allowed")
+}
+
+// PostMessage handles a frame sent over HTTP, the way SSE clients talk back
+// to the room. A JSON body is read as an envelope; a form is read like an
+// htmx ws-send frame. Replies such as the ack come back in the response.
+// It releases the reference from RoomManager.Open when done.
+func PostMessage(hub *Room, c echo.Context) error {
+	defer hub.manager.Release(hub)
+
+	req := c.Request()
+	if err := checkOrigin(req, hub.manager.cfg.AllowedOrigins); err != nil {
+		return err
+	}
+	isJSON := strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+
+	var raw []byte
+	if isJSON {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxPostSize))
+		if err != nil {
+			return err
+		}
+		raw = body
+	} else {
+		form, err := c.FormParams()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		fields := map[string]any{"HEADERS": map[string]string{}}
+		for k := range form {
+			fields[k] = form.Get(k)
+		}
+		raw, _ = json.Marshal(fields)
+	}
+
+	return postFrame(hub, c, raw, isJSON)
+}
+
+// EditMessage handles an edit over HTTP: the content of a JSON body, or of
+// the content field of a form, replaces the message in the path as a
+// chat.edit frame would. A JSON body may carry a client_id for the ack.
+// It releases the reference from RoomManager.Open when done.
+func EditMessage(hub *Room, c echo.Context) error {
+	defer hub.manager.Release(hub)
+
+	req := c.Request()
+	if err := checkOrigin(req, hub.manager.cfg.AllowedOrigins); err != nil {
+		return err
+	}
+	isJSON := strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON)
+
+	var edit struct {
+		ClientID string `json:"client_id"`
+		Content  string `json:"content"`
+	}
+	if isJSON {
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxPostSize)).Decode(&edit); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	} else {
+		edit.Content = c.FormValue("content")
+	}
+	raw, err := newFrame(EventChatEdit, edit.ClientID, hub.id, ChatEditPayload{
+		MessageID: c.Param("messageID"),
+		Content:   edit.Content,
+	})
+	if err != nil {
+		return err
+	}
+	return postFrame(hub, c, raw, isJSON)
+}
+
+// postFrame handles a frame sent over HTTP on a client of its own, and
+// answers with its replies.
+func postFrame(hub *Room, c echo.Context, raw []byte, isJSON bool) error {
+	req := c.Request()
+	subprotocol := SubprotocolHTMX
+	if isJSON {
+		subprotocol = SubprotocolJSON
+	}
+	client := newClient(req.Context(), hub.manager, hub, c, nil, subprotocol)
+	defer client.cancel()
+	client.detached = true
+	client.limiter = client.abuse.limiter(client.cfg)
+
+	env, p, err := decodeFrame(raw)
+	if admitErr := client.admit(env, len(raw)); admitErr != nil {
+		err = admitErr
+	} else if err == nil {
+		err = client.handle(env, p)
+	}
+	if err != nil {
+		client.sendError(env, err)
+	}
+
+	if len(client.replies) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	if isJSON {
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusUnprocessableEntity
+		}
+		return c.JSONBlob(status, client.replies[len(client.replies)-1])
+	}
+
+	// htmx only swaps successful responses, so errors come back as 200 too
+	var html, buf bytes.Buffer
+	for _, frame := range client.replies {
+		data, err := client.encode(req.Context(), &buf, newOutbound(frame))
+		if err != nil {
+			log.Println("Error encoding", err)
+		}
+		html.Write(data)
+	}
+	return c.HTMLBlob(http.StatusOK, html.Bytes())
+}
@@ -0,0 +1,71 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"rplatform-echo/internal/repository"
+	"rplatform-echo/internal/services"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+func TestEditMessage(t *testing.T) {
+	db := openDB(t, `insert into users (id, name, email, password) values ('u1', 'a@x', 'a@x', 'pw'), ('u2', 'b@x', 'b@x', 'pw');
+		insert into rooms (id, name) values ('r1', 'one');`)
+
+	ctx := context.Background()
+	q := repository.New(db)
+	messageSvc := services.NewMessageService(db, q, nil)
+	m := NewRoomManager(ctx, services.NewRoomService(q), messageSvc, nil, nil, NewMemoryBroker(), DefaultConfig())
+	msg, err := messageSvc.Create(ctx, "r1", "u1", "", "helo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	edit := func(userID string, body string) (*httptest.ResponseRecorder, error) {
+		room, err := m.Open(ctx, "r1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPatch, "/dashboard/room/r1/messages/"+msg.ID, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("roomID", "messageID")
+		c.SetParamValues("r1", msg.ID)
+		c.Set("user", &jwt.Token{Claims: jwt.MapClaims{"user_id": userID, "email": userID + "@x"}})
+		return rec, EditMessage(room, c)
+	}
+
+	for _, tc := range []struct {
+		user    string
+		status  int
+		typ     string
+		content string
+	}{
+		{"u2", http.StatusUnprocessableEntity, EventError, "helo"},
+		{"u1", http.StatusOK, EventChatAck, "hello"},
+	} {
+		rec, err := edit(tc.user, `{"client_id":"e1","content":"hello"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var env Envelope
+		if err := json.Unmarshal(rec.Body.Bytes(), &env); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tc.status || env.Type != tc.typ {
+			t.Errorf("edit by %s = %d %s, want %d %s", tc.user, rec.Code, rec.Body, tc.status, tc.typ)
+		}
+		if got, err := messageSvc.Get(ctx, "r1", msg.ID); err != nil || got.Content != tc.content {
+			t.Errorf("content after edit by %s = %q, %v, want %q", tc.user, got.Content, err, tc.content)
+		}
+	}
+}